@@ -0,0 +1,404 @@
+package davfs
+
+import (
+	"container/list"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// cacheBlockSize is the size of content blocks held by CacheFS.
+const cacheBlockSize = 64 * 1024
+
+type CacheOptions struct {
+	// TTL is the lifetime of cached entries.
+	TTL time.Duration
+	// MaxEntries limits the number of cached stats and directory listings.
+	MaxEntries int
+	// MaxBytes limits the total size of cached content blocks. zero
+	// disables content caching.
+	MaxBytes int64
+}
+
+// CacheFS is the read-through cache of other filesystem. stats, directory
+// listings and optionally content blocks are held in LRU caches, which are
+// invalidated on writes through CacheFS. writes by others are seen after
+// TTL, or after Invalidate is called.
+type CacheFS struct {
+	fs     webdav.FileSystem
+	stats  *lru
+	dirs   *lru
+	blocks *lru
+}
+
+type cacheFile struct {
+	webdav.File
+	c        *CacheFS
+	name     string
+	off      int64
+	children []os.FileInfo
+	dirOff   int
+}
+
+type writeFile struct {
+	webdav.File
+	c    *CacheFS
+	name string
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	size    int64
+	expires time.Time
+}
+
+// lru is the cache which evicts least recently used entries when the count
+// or the total size exceeds the limit.
+type lru struct {
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+	ttl      time.Duration
+	maxCount int
+	maxSize  int64
+	size     int64
+}
+
+func newLRU(ttl time.Duration, maxCount int, maxSize int64) *lru {
+	return &lru{
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+		ttl:      ttl,
+		maxCount: maxCount,
+		maxSize:  maxSize,
+	}
+}
+
+func (c *lru) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*lruEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lru) put(key string, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	entry := &lruEntry{key: key, value: value, size: size, expires: time.Now().Add(c.ttl)}
+	c.items[key] = c.ll.PushFront(entry)
+	c.size += size
+	for c.ll.Len() > 0 && ((c.maxCount > 0 && c.ll.Len() > c.maxCount) || (c.maxSize > 0 && c.size > c.maxSize)) {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *lru) remove(e *list.Element) {
+	entry := c.ll.Remove(e).(*lruEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
+
+// removeTree removes the entries of the name and its descendants. keys of
+// content blocks are the name followed by NUL.
+func (c *lru) removeTree(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dir := strings.TrimSuffix(name, "/") + "/"
+	for key, e := range c.items {
+		if key == name || strings.HasPrefix(key, dir) || strings.HasPrefix(key, name+"\x00") {
+			c.remove(e)
+		}
+	}
+}
+
+func (c *lru) removeKey(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+}
+
+func NewCacheFS(fs webdav.FileSystem, opts CacheOptions) *CacheFS {
+	c := &CacheFS{
+		fs:    fs,
+		stats: newLRU(opts.TTL, opts.MaxEntries, 0),
+		dirs:  newLRU(opts.TTL, opts.MaxEntries, 0),
+	}
+	if opts.MaxBytes > 0 {
+		c.blocks = newLRU(opts.TTL, 0, opts.MaxBytes)
+	}
+	return c
+}
+
+// Invalidate forgets the cached entries of the name and its descendants,
+// and the listing of its parent.
+func (c *CacheFS) Invalidate(name string) {
+	name, err := cleanName(name)
+	if err != nil {
+		return
+	}
+	c.stats.removeTree(name)
+	c.dirs.removeTree(name)
+	c.dirs.removeKey(path.Dir(name))
+	if c.blocks != nil {
+		c.blocks.removeTree(name)
+	}
+}
+
+type statResult struct {
+	fi  os.FileInfo
+	err error
+}
+
+func (c *CacheFS) stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if v, ok := c.stats.get(name); ok {
+		r := v.(*statResult)
+		return r.fi, r.err
+	}
+	fi, err := c.fs.Stat(ctx, name)
+	// missing entries are cached too, because clients ask them often.
+	if err == nil || os.IsNotExist(err) {
+		c.stats.put(name, &statResult{fi, err}, 0)
+	}
+	return fi, err
+}
+
+func (c *CacheFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	defer c.Invalidate(name)
+	return c.fs.Mkdir(ctx, name, perm)
+}
+
+func (c *CacheFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		c.Invalidate(name)
+		f, err := c.fs.OpenFile(ctx, name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &writeFile{File: f, c: c, name: name}, nil
+	}
+
+	if _, err = c.stat(ctx, name); err != nil {
+		return nil, err
+	}
+	f, err := c.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheFile{File: f, c: c, name: name}, nil
+}
+
+func (c *CacheFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	defer c.Invalidate(name)
+	return c.fs.RemoveAll(ctx, name)
+}
+
+func (c *CacheFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	defer c.Invalidate(newName)
+	defer c.Invalidate(oldName)
+	return c.fs.Rename(ctx, oldName, newName)
+}
+
+func (c *CacheFS) Copy(ctx context.Context, oldName, newName string) error {
+	cp, ok := c.fs.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	newName, err := cleanName(newName)
+	if err != nil {
+		return err
+	}
+	defer c.Invalidate(newName)
+	return cp.Copy(ctx, oldName, newName)
+}
+
+func (c *CacheFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.stat(ctx, name)
+}
+
+func (f *writeFile) Close() error {
+	defer f.c.Invalidate(f.name)
+	return f.File.Close()
+}
+
+func (f *writeFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *writeFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
+
+func (f *cacheFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *cacheFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
+
+func (f *cacheFile) Stat() (os.FileInfo, error) {
+	return f.c.stat(context.Background(), f.name)
+}
+
+func (f *cacheFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.children == nil {
+		if v, ok := f.c.dirs.get(f.name); ok {
+			f.children = v.([]os.FileInfo)
+		} else {
+			children, err := f.File.Readdir(-1)
+			if err != nil {
+				return nil, err
+			}
+			if children == nil {
+				children = []os.FileInfo{}
+			}
+			f.children = children
+			f.c.dirs.put(f.name, children, 0)
+			// PROPFIND stats every child after listing.
+			for _, fi := range children {
+				f.c.stats.put(path.Join(f.name, fi.Name()), &statResult{fi, nil}, 0)
+			}
+		}
+	}
+
+	old := f.dirOff
+	if old >= len(f.children) {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	if count > 0 {
+		f.dirOff += count
+		if f.dirOff > len(f.children) {
+			f.dirOff = len(f.children)
+		}
+	} else {
+		f.dirOff = len(f.children)
+		old = 0
+	}
+	return f.children[old:f.dirOff], nil
+}
+
+// block returns n-th content block of the file. key of the block contains
+// mod time and size, so blocks of the file changed by others are not used.
+func (f *cacheFile) block(fi os.FileInfo, n int64) ([]byte, error) {
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", f.name, fi.ModTime().UnixNano(), fi.Size(), n)
+	if v, ok := f.c.blocks.get(key); ok {
+		return v.([]byte), nil
+	}
+	if _, err := f.File.Seek(n*cacheBlockSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, cacheBlockSize)
+	l, err := io.ReadFull(f.File, b)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	b = b[:l]
+	f.c.blocks.put(key, b, int64(l))
+	return b, nil
+}
+
+func (f *cacheFile) Read(p []byte) (int, error) {
+	if f.c.blocks == nil {
+		return f.File.Read(p)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return 0, os.ErrInvalid
+	}
+	if f.off >= fi.Size() {
+		return 0, io.EOF
+	}
+	b, err := f.block(fi, f.off/cacheBlockSize)
+	if err != nil {
+		return 0, err
+	}
+	pos := f.off % cacheBlockSize
+	if pos >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[pos:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *cacheFile) Seek(offset int64, whence int) (int64, error) {
+	if f.c.blocks == nil {
+		return f.File.Seek(offset, whence)
+	}
+
+	off := f.off
+	switch whence {
+	case io.SeekStart:
+		off = 0
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		off = fi.Size()
+	}
+	off += offset
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.off = off
+	return f.off, nil
+}
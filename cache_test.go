@@ -0,0 +1,106 @@
+package davfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestLRU(t *testing.T) {
+	c := newLRU(0, 2, 0)
+	c.put("a", 1, 0)
+	c.put("b", 2, 0)
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a is evicted")
+	}
+	c.put("c", 3, 0)
+	if _, ok := c.get("b"); ok {
+		t.Fatal("least recently used b is kept")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("recently used a is evicted")
+	}
+
+	c = newLRU(0, 0, 10)
+	c.put("x", []byte("xxxxxx"), 6)
+	c.put("y", []byte("yyyyyy"), 6)
+	if _, ok := c.get("x"); ok || c.size != 6 {
+		t.Fatalf("entries over size: %v %d", ok, c.size)
+	}
+
+	c = newLRU(10*time.Millisecond, 0, 0)
+	c.put("a", 1, 0)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expired entry is returned")
+	}
+	if c.ll.Len() != 0 {
+		t.Fatalf("expired entry is kept: %d", c.ll.Len())
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, fs, "/dir/a.txt", "a")
+	c := NewCacheFS(fs, CacheOptions{TTL: time.Hour, MaxEntries: 100})
+
+	if names := strings.Join(readNames(t, c, "/dir"), ","); names != "a.txt" {
+		t.Fatalf("Readdir: %v", names)
+	}
+	if _, err := c.Stat(ctx, "/dir/b.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of missing file: %v", err)
+	}
+
+	// changes by others are not seen until invalidated.
+	putFile(t, fs, "/dir/b.txt", "b")
+	if names := strings.Join(readNames(t, c, "/dir"), ","); names != "a.txt" {
+		t.Fatalf("cached Readdir: %v", names)
+	}
+	if _, err := c.Stat(ctx, "/dir/b.txt"); !os.IsNotExist(err) {
+		t.Fatalf("cached Stat: %v", err)
+	}
+	c.Invalidate("/dir/b.txt")
+	if names := strings.Join(readNames(t, c, "/dir"), ","); names != "a.txt,b.txt" {
+		t.Fatalf("Readdir after Invalidate: %v", names)
+	}
+	if _, err := c.Stat(ctx, "/dir/b.txt"); err != nil {
+		t.Fatalf("Stat after Invalidate: %v", err)
+	}
+
+	// writes through the cache are seen at once.
+	putFile(t, c, "/dir/c.txt", "c")
+	if names := strings.Join(readNames(t, c, "/dir"), ","); names != "a.txt,b.txt,c.txt" {
+		t.Fatalf("Readdir after write: %v", names)
+	}
+	if err := c.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, "/dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of removed file: %v", err)
+	}
+}
+
+func TestCacheBlocks(t *testing.T) {
+	fs := webdav.NewMemFS()
+	putFile(t, fs, "/a.txt", "hello")
+	c := NewCacheFS(fs, CacheOptions{TTL: time.Hour, MaxEntries: 100, MaxBytes: 1 << 20})
+
+	if s := getFile(t, c, "/a.txt"); s != "hello" {
+		t.Fatalf("content: %q", s)
+	}
+	if c.blocks.size != 5 {
+		t.Fatalf("cached bytes: %d", c.blocks.size)
+	}
+	putFile(t, c, "/a.txt", "world!")
+	if s := getFile(t, c, "/a.txt"); s != "world!" {
+		t.Fatalf("content after write: %q", s)
+	}
+}
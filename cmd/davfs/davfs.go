@@ -1,18 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"encoding/xml"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"github.com/nkonev/davfs"
 	_ "github.com/nkonev/davfs/plugin/file"
+	_ "github.com/nkonev/davfs/plugin/git"
 	_ "github.com/nkonev/davfs/plugin/memory"
 	_ "github.com/nkonev/davfs/plugin/mysql"
+	_ "github.com/nkonev/davfs/plugin/overlay"
 	_ "github.com/nkonev/davfs/plugin/postgres"
+	_ "github.com/nkonev/davfs/plugin/redis"
+	_ "github.com/nkonev/davfs/plugin/s3"
+	_ "github.com/nkonev/davfs/plugin/sftp"
 	_ "github.com/nkonev/davfs/plugin/sqlite3"
+	_ "github.com/nkonev/davfs/plugin/webdav"
+	"golang.org/x/net/context"
 	"golang.org/x/net/webdav"
 )
 
@@ -22,8 +40,329 @@ var (
 	source = flag.String("source", ".", "database connection string")
 	cred   = flag.String("cred", "", "credential for basic auth")
 	create = flag.Bool("create", false, "create filesystem")
+	root   = flag.String("root", "/", "directory of the filesystem to be served as root")
+	ro     = flag.Bool("readonly", false, "serve filesystem read-only")
+
+	credFile = flag.String("cred-file", "", "file of credentials for basic auth, one user:password per line")
+	tenant   = flag.String("tenant", "", "serve each tenant with own directory of the filesystem, by user or host")
+	tenants  = flag.String("tenants", "", "tenants whose directories are created on first access with -tenant, separated by commas")
+
+	home       = flag.Bool("home", false, "serve each user with /home/<user> as root")
+	homeAdmins = flag.String("home-admins", "", "users served with the whole tree with -home, separated by commas")
+
+	compress = flag.String("compress", "", "compress stored content with the algorithm, gzip or zstd")
+
+	encryptKeyFile = flag.String("encrypt-key-file", "", "encrypt content with keys in the file, one hex 256-bit key per line, last one is current, names:<key> for names")
+	encryptKeyEnv  = flag.String("encrypt-key-env", "", "encrypt content with keys in the environment variable, separated by commas")
+	encryptNames   = flag.Bool("encrypt-names", false, "encrypt names too")
+	encryptRotate  = flag.Bool("encrypt-rotate", false, "re-encrypt content with the current key")
+	encryptPlain   = flag.Bool("encrypt-allow-plain", false, "read content without encryption as it is, to migrate with -encrypt-rotate")
+
+	cacheTTL     = flag.Duration("cache", 0, "cache stats and listings for the duration (0 disables)")
+	cacheEntries = flag.Int("cache-entries", 10000, "max number of cached stats and listings")
+	cacheBytes   = flag.Int64("cache-bytes", 0, "max bytes of cached content (0 disables)")
+
+	trash        = flag.Bool("trash", false, "move deleted entries to trash")
+	trashKeep    = flag.Duration("trash-retention", 30*24*time.Hour, "purge trashed entries after the duration (0 keeps them)")
+	trashList    = flag.Bool("trash-list", false, "list trashed entries")
+	trashRestore = flag.String("trash-restore", "", "restore trashed entry by ID, like ID or ID=/path/to/restore")
+
+	versions        = flag.Int("versions", 0, "keep the number of previous versions of each file (0 disables, unless -versions-age is set)")
+	versionsAge     = flag.Duration("versions-age", 0, "keep previous versions for the duration (0 keeps them)")
+	versionsList    = flag.String("versions-list", "", "list previous versions of the file")
+	versionsRestore = flag.String("versions-restore", "", "restore the version of the file like /path/to/file=ID")
+
+	mounts multiFlag
+	quotas multiFlag
 )
 
+// multiFlag holds the repeated flag like -mount /archive=file:/path/to/archive.
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, ",")
+}
+
+func (m *multiFlag) Set(value string) error {
+	*m = append(*m, value)
+	return nil
+}
+
+func init() {
+	flag.Var(&mounts, "mount", "mount driver:source at prefix like /prefix=driver:source (may be repeated)")
+	flag.Var(&quotas, "quota", "limit bytes and files under directory like /dir=10G:100000 (may be repeated)")
+}
+
+// parseSize parses size like 512, 64K, 10M, 2G or 1T.
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		case 'T', 't':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size << shift, nil
+}
+
+// parseQuota parses quota like /dir=10G:100000, where either limit can be
+// empty.
+func parseQuota(s string) (string, davfs.Quota, error) {
+	var quota davfs.Quota
+	token := strings.SplitN(s, "=", 2)
+	if len(token) != 2 {
+		return "", quota, os.ErrInvalid
+	}
+	limits := strings.SplitN(token[1], ":", 2)
+	var err error
+	if limits[0] != "" {
+		if quota.Bytes, err = parseSize(limits[0]); err != nil {
+			return "", quota, err
+		}
+	}
+	if len(limits) == 2 && limits[1] != "" {
+		if quota.Files, err = strconv.ParseInt(limits[1], 10, 64); err != nil {
+			return "", quota, err
+		}
+	}
+	return token[0], quota, nil
+}
+
+// quotaBody fails reads beyond the available bytes of chunked bodies.
+type quotaBody struct {
+	io.ReadCloser
+	avail    int64
+	exceeded bool
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.avail -= int64(n); b.avail < 0 {
+		b.exceeded = true
+		return 0, davfs.ErrQuotaExceeded
+	}
+	return n, err
+}
+
+// quotaWriter answers 507 instead of the error of webdav.Handler when the
+// body exceeded the quota.
+type quotaWriter struct {
+	http.ResponseWriter
+	body      *quotaBody
+	rewritten bool
+}
+
+func (w *quotaWriter) WriteHeader(code int) {
+	if code >= 400 && w.body.exceeded {
+		w.rewritten = true
+		http.Error(w.ResponseWriter, "quota exceeded", http.StatusInsufficientStorage)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if w.rewritten {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// quotaProps returns the request whose context asks for RFC 4331
+// properties if it is PROPFIND naming them.
+func quotaProps(r *http.Request) (*http.Request, error) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	var pf struct {
+		Prop struct {
+			Names []struct {
+				XMLName xml.Name
+			} `xml:",any"`
+		} `xml:"DAV: prop"`
+	}
+	if xml.Unmarshal(b, &pf) != nil {
+		return r, nil
+	}
+	for _, n := range pf.Prop.Names {
+		if n.XMLName.Space == "DAV:" && (n.XMLName.Local == "quota-available-bytes" || n.XMLName.Local == "quota-used-bytes") {
+			return r.WithContext(davfs.WithQuotaProps(r.Context())), nil
+		}
+	}
+	return r, nil
+}
+
+// quotaHandler answers 507 for PUT whose body exceeds the quota, before
+// webdav.Handler answers 405 on the failed write. bodies without length
+// are counted while they are read. paths of requests are under root of q.
+// RFC 4331 properties are reported only to PROPFIND naming them.
+func quotaHandler(h http.Handler, q *davfs.QuotaFS, root string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PROPFIND" {
+			r, err := quotaProps(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != "PUT" || r.ContentLength == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		avail, err := q.Available(r.Context(), path.Join(root, path.Dir(r.URL.Path)))
+		if err != nil || avail < 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > avail {
+			http.Error(w, "quota exceeded", http.StatusInsufficientStorage)
+			return
+		}
+		if r.ContentLength < 0 {
+			body := &quotaBody{ReadCloser: r.Body, avail: avail}
+			r.Body = body
+			w = &quotaWriter{ResponseWriter: w, body: body}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// replacedWriter answers 204 instead of 201 for the destination which
+// existed.
+type replacedWriter struct {
+	http.ResponseWriter
+}
+
+func (w replacedWriter) WriteHeader(code int) {
+	if code == http.StatusCreated {
+		code = http.StatusNoContent
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// copyHandler answers COPY with Copier of the filesystem, which copies
+// inside the storage instead of reading and writing each file through
+// webdav.Handler. requests with conditions, to locked destinations, or not
+// supported by the filesystem are passed to webdav.Handler.
+func copyHandler(h http.Handler, fs webdav.FileSystem, ls webdav.LockSystem) http.Handler {
+	c, ok := fs.(davfs.Copier)
+	if !ok {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "COPY" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// RFC 4918 section 10.6 allows only T and F.
+		if o := r.Header.Get("Overwrite"); o != "" && o != "T" && o != "F" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("If") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || (u.Host != "" && u.Host != r.Host) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		src, dst := path.Clean(r.URL.Path), path.Clean(u.Path)
+		if src == dst || strings.HasPrefix(dst, strings.TrimSuffix(src, "/")+"/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		fi, err := fs.Stat(ctx, src)
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		depth := r.Header.Get("Depth")
+		if fi.IsDir() && depth != "" && depth != "infinity" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// lock the destination while copying like webdav.Handler does.
+		token, err := ls.Create(time.Now(), webdav.LockDetails{Root: dst, Duration: -1, ZeroDepth: true})
+		if err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		release := func() { ls.Unlock(time.Now(), token) }
+
+		status := http.StatusCreated
+		if _, err = fs.Stat(ctx, dst); err == nil {
+			if r.Header.Get("Overwrite") == "F" {
+				release()
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			if err = fs.RemoveAll(ctx, dst); err != nil {
+				release()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			status = http.StatusNoContent
+		}
+		err = c.Copy(ctx, src, dst)
+		release()
+		switch {
+		case err == nil:
+			w.WriteHeader(status)
+		case err == davfs.ErrNotSupported && status == http.StatusNoContent:
+			// the destination was removed above.
+			h.ServeHTTP(replacedWriter{w}, r)
+		case err == davfs.ErrNotSupported:
+			h.ServeHTTP(w, r)
+		case os.IsNotExist(err):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case os.IsPermission(err):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err == davfs.ErrQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// readOnlyHandler rejects methods which modify the filesystem before they
+// reach to webdav.Handler, which answers 500 for some of them.
+func readOnlyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "PUT", "DELETE", "MKCOL", "COPY", "MOVE", "PROPPATCH":
+			http.Error(w, "read-only filesystem", http.StatusForbidden)
+			return
+		case "LOCK", "UNLOCK":
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, POST, PROPFIND")
+			http.Error(w, "read-only filesystem", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func errorString(err error) string {
 	if err != nil {
 		return err.Error()
@@ -31,26 +370,228 @@ func errorString(err error) string {
 	return ""
 }
 
-func main() {
-	flag.Parse()
+// collect collects garbage of the filesystem periodically if it is a
+// GarbageCollector.
+func collect(fs webdav.FileSystem) {
+	gc, ok := fs.(davfs.GarbageCollector)
+	if !ok {
+		return
+	}
+	go func() {
+		for {
+			if err := gc.GC(context.Background()); err != nil {
+				log.Printf("gc: %v", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
 
-	log.SetOutput(os.Stdout)
+// newHandler builds the handler serving the filesystem with the wrappers
+// given by the flags.
+func newHandler(fs webdav.FileSystem) (http.Handler, error) {
+	fs, qfs, err := wrapFS(fs)
+	if err != nil {
+		return nil, err
+	}
+	ls := webdav.NewMemLS()
+	serve := serveFS(fs, ls, qfs, "/")
+	if *home {
+		serve = homeHandler(serve, fs, ls, qfs)
+	}
+	return serve, nil
+}
 
-	if *create {
-		err := davfs.CreateFS(*driver, *source)
+// wrapFS wraps the filesystem with the wrappers given by the flags, which
+// is done once, so that the purge of trash and caches are shared by all
+// handlers serving it. it returns the QuotaFS of -quota, or nil. commands
+// like -trash-list are run on it and exit.
+func wrapFS(fs webdav.FileSystem) (webdav.FileSystem, *davfs.QuotaFS, error) {
+	var err error
+	if *encryptKeyFile != "" || *encryptKeyEnv != "" {
+		// filesystems of -mount are not encrypted.
+		if len(mounts) > 0 {
+			return nil, nil, errors.New("encryption can't be used with -mount")
+		}
+		var s string
+		if *encryptKeyFile != "" {
+			b, err := ioutil.ReadFile(*encryptKeyFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			s = string(b)
+		} else {
+			s = os.Getenv(*encryptKeyEnv)
+		}
+		keys, names, err := davfs.ParseKeys(s)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
-		os.Exit(0)
+		if !*encryptNames {
+			names = nil
+		} else if names == nil {
+			return nil, nil, errors.New("-encrypt-names needs the key of names")
+		}
+		efs, err := davfs.NewEncryptFS(fs, keys, names)
+		if err != nil {
+			return nil, nil, err
+		}
+		efs.AllowPlain = *encryptPlain
+		if *encryptRotate {
+			if err = efs.Rotate(context.Background(), "/"); err != nil {
+				return nil, nil, err
+			}
+			os.Exit(0)
+		}
+		fs = efs
 	}
-	fs, err := davfs.NewFS(*driver, *source)
-	if err != nil {
-		log.Fatal(err)
+	if *root != "/" {
+		if fs, err = davfs.NewSubtreeFS(fs, *root); err != nil {
+			return nil, nil, err
+		}
 	}
+	if len(mounts) > 0 {
+		mfs := davfs.NewMountFS()
+		if err = mfs.Mount("/", fs); err != nil {
+			return nil, nil, err
+		}
+		for _, m := range mounts {
+			token := strings.SplitN(m, "=", 2)
+			if len(token) != 2 {
+				return nil, nil, errUsage
+			}
+			ds := strings.SplitN(token[1], ":", 2)
+			if len(ds) != 2 {
+				return nil, nil, errUsage
+			}
+			sub, err := davfs.NewFS(ds[0], ds[1])
+			if err != nil {
+				return nil, nil, err
+			}
+			if err = mfs.Mount(token[0], sub); err != nil {
+				return nil, nil, err
+			}
+		}
+		fs = mfs
+	}
+	if *compress != "" {
+		if fs, err = davfs.NewCompressFS(fs, *compress); err != nil {
+			return nil, nil, errUsage
+		}
+	}
+	var qfs *davfs.QuotaFS
+	if len(quotas) > 0 {
+		limits := map[string]davfs.Quota{}
+		for _, s := range quotas {
+			name, quota, err := parseQuota(s)
+			if err != nil {
+				return nil, nil, errUsage
+			}
+			limits[name] = quota
+		}
+		if qfs, err = davfs.NewQuotaFS(fs, limits); err != nil {
+			return nil, nil, err
+		}
+		fs = qfs
+	}
+	if *versions > 0 || *versionsAge > 0 || *versionsList != "" || *versionsRestore != "" {
+		vfs := davfs.NewVersionFS(fs, davfs.VersionOptions{
+			MaxVersions: *versions,
+			MaxAge:      *versionsAge,
+		})
+		ctx := context.Background()
+		switch {
+		case *versionsList != "":
+			vers, err := vfs.Versions(ctx, *versionsList)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, v := range vers {
+				fmt.Printf("%s\t%s\t%d\n", v.ID, v.Replaced.Local().Format(time.RFC3339), v.Size)
+			}
+			os.Exit(0)
+		case *versionsRestore != "":
+			token := strings.SplitN(*versionsRestore, "=", 2)
+			if len(token) != 2 {
+				return nil, nil, errUsage
+			}
+			if err = vfs.Restore(ctx, token[0], token[1]); err != nil {
+				return nil, nil, err
+			}
+			os.Exit(0)
+		}
+		if *versionsAge > 0 {
+			go func() {
+				for {
+					if err := vfs.Purge(ctx); err != nil {
+						log.Printf("purge versions: %v", err)
+					}
+					time.Sleep(time.Hour)
+				}
+			}()
+		}
+		fs = vfs
+	}
+	if *trash || *trashList || *trashRestore != "" {
+		tfs := davfs.NewTrashFS(fs, *trashKeep)
+		ctx := context.Background()
+		switch {
+		case *trashList:
+			entries, err := tfs.List(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, e := range entries {
+				fmt.Printf("%s\t%s\t%d\t%s\n", e.ID, e.Deleted.Local().Format(time.RFC3339), e.Size, e.Path)
+			}
+			os.Exit(0)
+		case *trashRestore != "":
+			token := strings.SplitN(*trashRestore, "=", 2)
+			name := ""
+			if len(token) == 2 {
+				name = token[1]
+			}
+			if err = tfs.Restore(ctx, token[0], name); err != nil {
+				return nil, nil, err
+			}
+			os.Exit(0)
+		}
+		go func() {
+			for {
+				if err := tfs.Purge(ctx); err != nil {
+					log.Printf("purge trash: %v", err)
+				}
+				time.Sleep(time.Hour)
+			}
+		}()
+		fs = tfs
+	}
+	if *cacheTTL > 0 {
+		cache := davfs.NewCacheFS(fs, davfs.CacheOptions{
+			TTL:        *cacheTTL,
+			MaxEntries: *cacheEntries,
+			MaxBytes:   *cacheBytes,
+		})
+		// drop entries changed by other instances sharing the storage.
+		if w, ok := fs.(davfs.Watcher); ok {
+			if err = w.Watch(cache.Invalidate); err != nil {
+				return nil, nil, err
+			}
+		}
+		fs = cache
+	}
+	if *ro {
+		fs = davfs.NewReadOnlyFS(fs)
+	}
+	return fs, qfs, nil
+}
 
+// serveFS returns the handler serving the filesystem with the lock system.
+// root is the directory of fs in the filesystem wrapped by qfs.
+func serveFS(fs webdav.FileSystem, ls webdav.LockSystem, qfs *davfs.QuotaFS, root string) http.Handler {
 	dav := &webdav.Handler{
 		FileSystem: fs,
-		LockSystem: webdav.NewMemLS(),
+		LockSystem: ls,
 		Logger: func(r *http.Request, err error) {
 			litmus := r.Header.Get("X-Litmus")
 			if len(litmus) > 19 {
@@ -73,25 +614,350 @@ func main() {
 		},
 	}
 
-	var handler http.Handler
+	var serve http.Handler = copyHandler(dav, fs, dav.LockSystem)
+	if qfs != nil {
+		serve = quotaHandler(serve, qfs, root)
+	}
+	if *ro {
+		serve = readOnlyHandler(serve)
+	}
+	return serve
+}
+
+// subtreeLS is the lock system of the directory root of other lock system,
+// so that locks of the home directories and the whole tree conflict.
+type subtreeLS struct {
+	ls   webdav.LockSystem
+	root string
+}
+
+func (s *subtreeLS) resolve(name string) string {
+	if name == "" {
+		return ""
+	}
+	return path.Join(s.root, path.Clean("/"+name))
+}
+
+func (s *subtreeLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	return s.ls.Confirm(now, s.resolve(name0), s.resolve(name1), conditions...)
+}
+
+func (s *subtreeLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = s.resolve(details.Root)
+	return s.ls.Create(now, details)
+}
+
+func (s *subtreeLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := s.ls.Refresh(now, token, duration)
+	if err != nil {
+		return details, err
+	}
+	if details.Root == s.root {
+		details.Root = "/"
+	} else if strings.HasPrefix(details.Root, s.root+"/") {
+		details.Root = details.Root[len(s.root):]
+	} else {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	return details, nil
+}
+
+func (s *subtreeLS) Unlock(now time.Time, token string) error {
+	return s.ls.Unlock(now, token)
+}
+
+// homeHandler serves each user with the home directory /home/<user> of fs
+// as the root, which is created on first access unless -readonly. users of
+// -home-admins are served with h, which serves the whole tree. locks of ls
+// are shared by all of them.
+func homeHandler(h http.Handler, fs webdav.FileSystem, ls webdav.LockSystem, qfs *davfs.QuotaFS) http.Handler {
+	admins := map[string]bool{}
+	for _, user := range strings.Split(*homeAdmins, ",") {
+		if user != "" {
+			admins[user] = true
+		}
+	}
+	var mu sync.Mutex
+	handlers := map[string]http.Handler{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := davfs.UserFromContext(r.Context())
+		if admins[user] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if user == "" || user == "." || user == ".." || strings.Contains(user, "/") {
+			http.Error(w, "no home directory", http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		uh, ok := handlers[user]
+		if !ok {
+			root := path.Join("/home", user)
+			var err error
+			for _, dir := range []string{"/home", root} {
+				if _, err = fs.Stat(r.Context(), dir); os.IsNotExist(err) && !*ro {
+					err = fs.Mkdir(r.Context(), dir, 0755)
+				}
+				if err != nil {
+					break
+				}
+			}
+			var sub *davfs.SubtreeFS
+			if err == nil {
+				sub, err = davfs.NewSubtreeFS(fs, root)
+			}
+			if os.IsNotExist(err) {
+				mu.Unlock()
+				http.Error(w, "no home directory", http.StatusForbidden)
+				return
+			} else if err != nil {
+				mu.Unlock()
+				log.Printf("home %s: %v", root, err)
+				http.Error(w, "home directory unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			uh = serveFS(sub, &subtreeLS{ls, root}, qfs, root)
+			handlers[user] = uh
+		}
+		mu.Unlock()
+		uh.ServeHTTP(w, r)
+	})
+}
+
+// errUsage is returned by newHandler for invalid flags.
+var errUsage = errors.New("invalid flags")
+
+// maxTenant is the max length of tenant names, so that the directories of
+// tenants fit in names of every driver.
+const maxTenant = 48
+
+// tenantName returns the name of the tenant for the user or the host, which
+// is the name of its directory. letters other than a-z and 0-9 are escaped
+// like _2e, so that different keys never share the name.
+func tenantName(key string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "_%02x", c)
+		}
+	}
+	if b.Len() == 0 || b.Len() > maxTenant {
+		return "", os.ErrInvalid
+	}
+	return b.String(), nil
+}
+
+// mountTenant returns the handler serving the directory /<tenant> of fs as
+// the root, with the locks of the directory in ls. the directory is created
+// if it doesn't exist and create is true.
+func mountTenant(ctx context.Context, fs webdav.FileSystem, ls webdav.LockSystem, qfs *davfs.QuotaFS, name string, create bool) (http.Handler, error) {
+	dir := "/" + name
+	_, err := fs.Stat(ctx, dir)
+	if os.IsNotExist(err) && create && !*ro {
+		err = fs.Mkdir(ctx, dir, 0755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sub, err := davfs.NewSubtreeFS(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	return serveFS(sub, &subtreeLS{ls, dir}, qfs, dir), nil
+}
+
+// tenantHandler serves each tenant with own directory of fs as the root,
+// so that tenants share one filesystem but never see entries of others.
+// fs is wrapped once by wrapFS for all tenants, and qfs is the QuotaFS in
+// it, so trash and versions are kept out of the directories of tenants. the
+// tenant is the authenticated user, or the host of the request. directories
+// of tenants in allowed are created on first access, and other tenants are
+// served only if their directories exist.
+func tenantHandler(by string, fs webdav.FileSystem, qfs *davfs.QuotaFS, allowed map[string]bool) http.Handler {
+	type entry struct {
+		mu sync.Mutex
+		h  http.Handler
+	}
+	var mu sync.Mutex
+	ls := webdav.NewMemLS()
+	entries := map[string]*entry{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var key string
+		switch by {
+		case "user":
+			key, _ = davfs.UserFromContext(r.Context())
+		case "host":
+			key = r.Host
+			if host, _, err := net.SplitHostPort(key); err == nil {
+				key = host
+			}
+			key = strings.ToLower(key)
+		}
+		name, err := tenantName(key)
+		if err != nil {
+			http.Error(w, "unknown tenant", http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		e, ok := entries[name]
+		mu.Unlock()
+		if !ok {
+			// unknown tenants are never kept, so that they can't grow
+			// entries.
+			if !allowed[name] {
+				_, err = fs.Stat(r.Context(), "/"+name)
+				if os.IsNotExist(err) {
+					http.Error(w, "unknown tenant", http.StatusForbidden)
+					return
+				} else if err != nil {
+					log.Printf("tenant %s: %v", name, err)
+					http.Error(w, "tenant unavailable", http.StatusServiceUnavailable)
+					return
+				}
+			}
+			mu.Lock()
+			if e, ok = entries[name]; !ok {
+				e = &entry{}
+				entries[name] = e
+			}
+			mu.Unlock()
+		}
+
+		// entries are locked each, so that mounting a tenant doesn't block
+		// others.
+		e.mu.Lock()
+		if e.h == nil {
+			e.h, err = mountTenant(r.Context(), fs, ls, qfs, name, allowed[name])
+		}
+		h := e.h
+		e.mu.Unlock()
+		if os.IsNotExist(err) {
+			http.Error(w, "unknown tenant", http.StatusForbidden)
+			return
+		} else if err != nil {
+			log.Printf("tenant %s: %v", name, err)
+			http.Error(w, "tenant unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseCreds parses credentials of -cred and lines of -cred-file like
+// user:password. lines starting with # are ignored.
+func parseCreds() (map[string]string, error) {
+	lines := []string{}
 	if *cred != "" {
-		token := strings.SplitN(*cred, ":", 2)
+		lines = append(lines, *cred)
+	}
+	if *credFile != "" {
+		b, err := ioutil.ReadFile(*credFile)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, strings.Split(string(b), "\n")...)
+	}
+	creds := map[string]string{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		token := strings.SplitN(line, ":", 2)
 		if len(token) != 2 {
+			return nil, errUsage
+		}
+		creds[token[0]] = token[1]
+	}
+	return creds, nil
+}
+
+func main() {
+	flag.Parse()
+
+	log.SetOutput(os.Stdout)
+
+	if *create {
+		err := davfs.CreateFS(*driver, *source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	creds, err := parseCreds()
+	if err == errUsage {
+		flag.Usage()
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	if *home && len(creds) == 0 {
+		flag.Usage()
+		return
+	}
+
+	fs, err := davfs.NewFS(*driver, *source)
+	if err != nil {
+		log.Fatal(err)
+	}
+	collect(fs)
+
+	var serve http.Handler
+	if *tenant != "" {
+		// commands are run on the whole tree without -tenant. filesystems
+		// of -mount would be out of the directories of tenants.
+		if *tenant != "user" && *tenant != "host" || *tenant == "user" && len(creds) == 0 ||
+			len(mounts) > 0 || *home || *encryptRotate ||
+			*trashList || *trashRestore != "" || *versionsList != "" || *versionsRestore != "" {
 			flag.Usage()
 			return
 		}
-		user, pass := token[0], token[1]
+		allowed := map[string]bool{}
+		for _, key := range strings.Split(*tenants, ",") {
+			if key == "" {
+				continue
+			}
+			name, err := tenantName(key)
+			if err != nil {
+				flag.Usage()
+				return
+			}
+			allowed[name] = true
+		}
+		wrapped, qfs, err := wrapFS(fs)
+		if err == errUsage {
+			flag.Usage()
+			return
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		serve = tenantHandler(*tenant, wrapped, qfs, allowed)
+	} else if serve, err = newHandler(fs); err == errUsage {
+		flag.Usage()
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	var handler http.Handler
+	if len(creds) > 0 {
 		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			username, password, ok := r.BasicAuth()
-			if !ok || username != user || password != pass {
+			if pass, found := creds[username]; !ok || !found || password != pass {
 				w.Header().Set("WWW-Authenticate", `Basic realm="davfs"`)
 				http.Error(w, "authorization failed", http.StatusUnauthorized)
 				return
 			}
-			dav.ServeHTTP(w, r)
+			serve.ServeHTTP(w, r.WithContext(davfs.WithUser(r.Context(), username)))
 		})
 	} else {
-		handler = dav
+		handler = serve
 	}
 
 	log.Printf("Server started %v", *addr)
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nkonev/davfs"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func request(t *testing.T, h http.Handler, method, host, user, name, body string) (int, string) {
+	r := httptest.NewRequest(method, "http://"+host+name, strings.NewReader(body))
+	if user != "" {
+		r = r.WithContext(davfs.WithUser(r.Context(), user))
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	b, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, string(b)
+}
+
+func TestTenantRouting(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	if err := fs.Mkdir(ctx, "/b_2eexample", 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := tenantHandler("host", fs, nil, map[string]bool{"a_2eexample": true})
+
+	if code, _ := request(t, h, "PUT", "A.example:9999", "", "/x.txt", "a"); code != http.StatusCreated {
+		t.Fatalf("PUT of allowed tenant: %d", code)
+	}
+	if code, _ := request(t, h, "PUT", "b.example", "", "/x.txt", "b"); code != http.StatusCreated {
+		t.Fatalf("PUT of existing tenant: %d", code)
+	}
+	if _, body := request(t, h, "GET", "a.example", "", "/x.txt", ""); body != "a" {
+		t.Fatalf("content of a.example: %q", body)
+	}
+	if _, body := request(t, h, "GET", "b.example", "", "/x.txt", ""); body != "b" {
+		t.Fatalf("content of b.example: %q", body)
+	}
+	if code, _ := request(t, h, "GET", "a.example", "", "/../b_2eexample/x.txt", ""); code != http.StatusNotFound {
+		t.Fatalf("GET of other tenant: %d", code)
+	}
+
+	if code, _ := request(t, h, "PUT", "c.example", "", "/x.txt", "c"); code != http.StatusForbidden {
+		t.Fatalf("PUT of unknown tenant: %d", code)
+	}
+	if _, err := fs.Stat(ctx, "/c_2eexample"); err == nil {
+		t.Fatal("directory of unknown tenant is created")
+	}
+
+	h = tenantHandler("user", fs, nil, map[string]bool{"alice": true})
+	if code, _ := request(t, h, "PUT", "a.example", "alice", "/x.txt", "alice"); code != http.StatusCreated {
+		t.Fatalf("PUT of user: %d", code)
+	}
+	if code, _ := request(t, h, "GET", "a.example", "bob", "/x.txt", ""); code != http.StatusForbidden {
+		t.Fatalf("GET of unknown user: %d", code)
+	}
+	if code, _ := request(t, h, "GET", "a.example", "", "/x.txt", ""); code != http.StatusForbidden {
+		t.Fatalf("GET without user: %d", code)
+	}
+}
+
+func TestHomeLocks(t *testing.T) {
+	defer func(admins string) { *homeAdmins = admins }(*homeAdmins)
+	*homeAdmins = "root"
+
+	fs := webdav.NewMemFS()
+	ls := webdav.NewMemLS()
+	h := homeHandler(serveFS(fs, ls, nil, "/"), fs, ls, nil)
+
+	if code, _ := request(t, h, "PUT", "a.example", "alice", "/x.txt", "a"); code != http.StatusCreated {
+		t.Fatalf("PUT of home: %d", code)
+	}
+	if _, body := request(t, h, "GET", "a.example", "root", "/home/alice/x.txt", ""); body != "a" {
+		t.Fatalf("content of home by admin: %q", body)
+	}
+	lockinfo := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+	if code, _ := request(t, h, "LOCK", "a.example", "root", "/home/alice/x.txt", lockinfo); code != http.StatusOK {
+		t.Fatalf("LOCK by admin: %d", code)
+	}
+	if code, _ := request(t, h, "PUT", "a.example", "alice", "/x.txt", "b"); code != http.StatusLocked {
+		t.Fatalf("PUT of file locked by admin: %d", code)
+	}
+}
+
+func TestQuotaProps(t *testing.T) {
+	qfs, err := davfs.NewQuotaFS(webdav.NewMemFS(), map[string]davfs.Quota{"/": {Bytes: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := serveFS(qfs, webdav.NewMemLS(), qfs, "/")
+
+	allprop := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`
+	if code, body := request(t, h, "PROPFIND", "a.example", "", "/", allprop); code != http.StatusMultiStatus || strings.Contains(body, "quota-") {
+		t.Fatalf("PROPFIND of allprop: %d %s", code, body)
+	}
+	prop := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/></D:prop></D:propfind>`
+	if code, body := request(t, h, "PROPFIND", "a.example", "", "/", prop); code != http.StatusMultiStatus || !strings.Contains(body, ">10</") {
+		t.Fatalf("PROPFIND of quota-available-bytes: %d %s", code, body)
+	}
+}
+
+// copyFS copies with webdav.MemFS by the handler, counting copies.
+type copyFS struct {
+	webdav.FileSystem
+	copies int
+}
+
+func (fs *copyFS) Copy(ctx context.Context, oldName, newName string) error {
+	fs.copies++
+	return davfs.ErrNotSupported
+}
+
+func TestCopyOverwrite(t *testing.T) {
+	fs := &copyFS{FileSystem: webdav.NewMemFS()}
+	h := serveFS(fs, webdav.NewMemLS(), nil, "/")
+	request(t, h, "PUT", "a.example", "", "/a.txt", "a")
+	request(t, h, "PUT", "a.example", "", "/b.txt", "b")
+
+	copyTo := func(overwrite string) int {
+		r := httptest.NewRequest("COPY", "http://a.example/a.txt", nil)
+		r.Header.Set("Destination", "http://a.example/b.txt")
+		if overwrite != "" {
+			r.Header.Set("Overwrite", overwrite)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	for _, overwrite := range []string{"f", "t", "X"} {
+		if code := copyTo(overwrite); code != http.StatusBadRequest {
+			t.Fatalf("COPY with Overwrite %q: %d", overwrite, code)
+		}
+	}
+	if fs.copies != 0 {
+		t.Fatalf("%d copies with invalid Overwrite", fs.copies)
+	}
+	if code := copyTo("F"); code != http.StatusPreconditionFailed {
+		t.Fatalf("COPY with Overwrite F: %d", code)
+	}
+	if code := copyTo(""); code != http.StatusNoContent {
+		t.Fatalf("COPY without Overwrite: %d", code)
+	}
+	if _, body := request(t, h, "GET", "a.example", "", "/b.txt", ""); body != "a" || fs.copies != 1 {
+		t.Fatalf("content of copy: %q after %d copies", body, fs.copies)
+	}
+}
+
+func TestTenantEscape(t *testing.T) {
+	defer func(trashed bool, kept int) { *trash, *versions = trashed, kept }(*trash, *versions)
+	*trash, *versions = true, 2
+
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	fs, qfs, err := wrapFS(mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := tenantHandler("host", fs, qfs, map[string]bool{"a_2eexample": true, "b_2eexample": true})
+	request(t, h, "PUT", "b.example", "", "/b.txt", "b")
+	request(t, h, "PUT", "a.example", "", "/x.txt", "v1")
+	request(t, h, "PUT", "a.example", "", "/x.txt", "v2")
+	if code, _ := request(t, h, "DELETE", "a.example", "", "/x.txt", ""); code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d", code)
+	}
+
+	// trash and versions of tenants are kept at the top of the shared
+	// filesystem, out of reach of tenants.
+	for _, name := range []string{"/.trash", "/.versions"} {
+		if _, err = mem.Stat(ctx, name); err != nil {
+			t.Fatalf("Stat of %s: %v", name, err)
+		}
+	}
+	for _, name := range []string{"/.trash", "/.versions", "/.versions/x.txt/", "/../.trash", "/../.versions/a_2eexample/x.txt/", "/../b_2eexample/b.txt"} {
+		if code, _ := request(t, h, "GET", "a.example", "", name, ""); code != http.StatusNotFound {
+			t.Fatalf("GET of %s: %d", name, code)
+		}
+	}
+	propfind := `<?xml version="1.0" encoding="utf-8"?><D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`
+	if _, body := request(t, h, "PROPFIND", "a.example", "", "/", propfind); strings.Contains(body, ".trash") || strings.Contains(body, ".versions") || strings.Contains(body, "b_2eexample") {
+		t.Fatalf("PROPFIND of root: %s", body)
+	}
+
+	// destinations are resolved in the directory of the tenant.
+	request(t, h, "PUT", "a.example", "", "/z.txt", "z")
+	for _, method := range []string{"COPY", "MOVE"} {
+		for _, dst := range []string{"/../b_2eexample/z.txt", "/../.trash/z.txt", "/../.versions/z.txt", "/../z.txt"} {
+			r := httptest.NewRequest(method, "http://a.example/z.txt", nil)
+			r.Header.Set("Destination", "http://a.example"+dst)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if _, err = mem.Stat(ctx, path.Clean(dst)); !os.IsNotExist(err) {
+				t.Fatalf("%s to %s: %d, %v", method, dst, w.Code, err)
+			}
+		}
+	}
+	if _, body := request(t, h, "GET", "a.example", "", "/z.txt", ""); body != "z" {
+		t.Fatalf("content of z.txt after COPY and MOVE: %q", body)
+	}
+	if names := readNames(t, mem, "/b_2eexample"); len(names) != 1 || names[0] != "b.txt" {
+		t.Fatalf("entries of other tenant: %v", names)
+	}
+}
+
+func readNames(t *testing.T, fs webdav.FileSystem, name string) []string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	children, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range children {
+		names = append(names, fi.Name())
+	}
+	return names
+}
@@ -0,0 +1,468 @@
+package davfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// compressed content starts with the header of magic, codec, chunk size
+// and uncompressed size, which is followed by compressed sizes of chunks
+// and the chunks. chunks are compressed independently, so that reads at
+// any offset decompress only the chunk.
+const (
+	compressMagic      = "DAVZ"
+	compressHeaderSize = 20
+	compressChunkSize  = 64 * 1024
+	compressMaxChunk   = 16 << 20
+)
+
+type codec struct {
+	id         byte
+	compress   func(b []byte) ([]byte, error)
+	decompress func(b []byte) ([]byte, error)
+}
+
+var codecs = map[string]*codec{
+	"gzip": {
+		id: 1,
+		compress: func(b []byte) ([]byte, error) {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			if _, err := w.Write(b); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		},
+	},
+	"zstd": {
+		id: 2,
+		compress: func(b []byte) ([]byte, error) {
+			return zstdEncoder.EncodeAll(b, nil), nil
+		},
+		decompress: func(b []byte) ([]byte, error) {
+			return zstdDecoder.DecodeAll(b, nil)
+		},
+	},
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func codecByID(id byte) *codec {
+	for _, c := range codecs {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// CompressFS is the filesystem which compresses content of files of other
+// filesystem at rest. files which don't have the header, e.g. written
+// before, or not smaller by compression, are read as they are. it is not a
+// Usager, so that quotas count uncompressed bytes as they are written.
+//
+// sizes of files in listings of directories are the stored ones, not to
+// open every file. Stat returns uncompressed sizes.
+type CompressFS struct {
+	fs    webdav.FileSystem
+	codec *codec
+}
+
+type compressHeader struct {
+	codec   *codec
+	chunk   int64
+	size    int64
+	offsets []int64
+}
+
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *sizedInfo) Size() int64 { return fi.size }
+
+type compressFile struct {
+	webdav.File
+	c     *CompressFS
+	ctx   context.Context
+	name  string
+	perm  os.FileMode
+	dir   bool
+	hdr   *compressHeader
+	size  int64
+	off   int64
+	n     int64
+	buf   []byte
+	spool *os.File
+}
+
+// NewCompressFS returns CompressFS which compresses with the algorithm,
+// gzip or zstd.
+func NewCompressFS(fs webdav.FileSystem, algorithm string) (*CompressFS, error) {
+	c, ok := codecs[algorithm]
+	if !ok {
+		return nil, os.ErrInvalid
+	}
+	return &CompressFS{fs: fs, codec: c}, nil
+}
+
+// readHeader reads the header of compressed content of the stored size. it
+// returns nil for content which is not compressed, and os.ErrInvalid for
+// the header which doesn't agree with the stored size.
+func readHeader(r io.ReadSeeker, stored int64) (*compressHeader, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var b [compressHeaderSize]byte
+	_, err := io.ReadFull(r, b[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(b[:4]) != compressMagic {
+		return nil, nil
+	}
+	hdr := &compressHeader{
+		codec: codecByID(b[4]),
+		chunk: int64(binary.BigEndian.Uint32(b[8:])),
+		size:  int64(binary.BigEndian.Uint64(b[12:])),
+	}
+	if hdr.codec == nil || hdr.chunk == 0 || hdr.chunk > compressMaxChunk || hdr.size < 0 {
+		return nil, os.ErrInvalid
+	}
+
+	n := hdr.size / hdr.chunk
+	if hdr.size%hdr.chunk != 0 {
+		n++
+	}
+	// the index has 4 bytes for each chunk.
+	if n > (stored-compressHeaderSize)/4 {
+		return nil, os.ErrInvalid
+	}
+	index := make([]byte, 4*n)
+	if _, err = io.ReadFull(r, index); err != nil {
+		return nil, err
+	}
+	off := int64(compressHeaderSize) + 4*n
+	hdr.offsets = make([]int64, n+1)
+	for i := int64(0); i < n; i++ {
+		hdr.offsets[i] = off
+		off += int64(binary.BigEndian.Uint32(index[4*i:]))
+	}
+	hdr.offsets[n] = off
+	if off != stored {
+		return nil, os.ErrInvalid
+	}
+	return hdr, nil
+}
+
+// stat returns the info with uncompressed size.
+func (c *CompressFS) stat(ctx context.Context, name string, fi os.FileInfo) (os.FileInfo, error) {
+	if fi.IsDir() || fi.Size() < compressHeaderSize {
+		return fi, nil
+	}
+	f, err := c.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hdr, err := readHeader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if hdr == nil {
+		return fi, nil
+	}
+	return &sizedInfo{fi, hdr.size}, nil
+}
+
+func (c *CompressFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return c.fs.Mkdir(ctx, name, perm)
+}
+
+func (c *CompressFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cf := &compressFile{File: f, c: c, ctx: ctx, name: name, perm: perm, dir: fi.IsDir(), n: -1}
+	if cf.dir {
+		return cf, nil
+	}
+	if cf.hdr, err = readHeader(f, fi.Size()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	cf.size = fi.Size()
+	if cf.hdr != nil {
+		cf.size = cf.hdr.size
+	}
+	if flag&os.O_APPEND != 0 {
+		cf.off = cf.size
+	}
+	return cf, nil
+}
+
+func (c *CompressFS) RemoveAll(ctx context.Context, name string) error {
+	return c.fs.RemoveAll(ctx, name)
+}
+
+func (c *CompressFS) Rename(ctx context.Context, oldName, newName string) error {
+	return c.fs.Rename(ctx, oldName, newName)
+}
+
+// Copy copies compressed content as it is.
+func (c *CompressFS) Copy(ctx context.Context, oldName, newName string) error {
+	if cp, ok := c.fs.(Copier); ok {
+		return cp.Copy(ctx, oldName, newName)
+	}
+	return ErrNotSupported
+}
+
+func (c *CompressFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := c.fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.stat(ctx, name, fi)
+}
+
+func (c *CompressFS) Watch(fn func(name string)) error {
+	if w, ok := c.fs.(Watcher); ok {
+		return w.Watch(fn)
+	}
+	return nil
+}
+
+// readAt reads the content at the offset, from the spool if the file is
+// written.
+func (f *compressFile) readAt(p []byte, off int64) (int, error) {
+	if f.spool != nil {
+		n, err := f.spool.ReadAt(p, off)
+		if n > 0 && err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	if f.hdr == nil {
+		if _, err := f.File.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return f.File.Read(p)
+	}
+
+	if off >= f.hdr.size {
+		return 0, io.EOF
+	}
+	n := off / f.hdr.chunk
+	if n != f.n {
+		b := make([]byte, f.hdr.offsets[n+1]-f.hdr.offsets[n])
+		if _, err := f.File.Seek(f.hdr.offsets[n], io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(f.File, b); err != nil {
+			return 0, err
+		}
+		buf, err := f.hdr.codec.decompress(b)
+		if err != nil {
+			return 0, err
+		}
+		f.n, f.buf = n, buf
+	}
+	pos := off - n*f.hdr.chunk
+	if pos >= int64(len(f.buf)) {
+		return 0, io.EOF
+	}
+	return copy(p, f.buf[pos:]), nil
+}
+
+func (f *compressFile) Read(p []byte) (int, error) {
+	if f.dir {
+		return 0, os.ErrInvalid
+	}
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// Write writes to the spool which holds uncompressed content, which is
+// compressed on Close.
+func (f *compressFile) Write(p []byte) (int, error) {
+	if f.dir {
+		return 0, os.ErrInvalid
+	}
+	if f.spool == nil {
+		spool, err := ioutil.TempFile("", "davfs")
+		if err != nil {
+			return 0, err
+		}
+		buf := make([]byte, compressChunkSize)
+		for off := int64(0); off < f.size; {
+			n, err := f.readAt(buf, off)
+			if n > 0 {
+				if _, err := spool.Write(buf[:n]); err != nil {
+					spool.Close()
+					os.Remove(spool.Name())
+					return 0, err
+				}
+				off += int64(n)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				spool.Close()
+				os.Remove(spool.Name())
+				return 0, err
+			}
+		}
+		f.spool = spool
+	}
+	n, err := f.spool.WriteAt(p, f.off)
+	f.off += int64(n)
+	if f.off > f.size {
+		f.size = f.off
+	}
+	return n, err
+}
+
+func (f *compressFile) Seek(offset int64, whence int) (int64, error) {
+	if f.dir {
+		return f.File.Seek(offset, whence)
+	}
+	off := f.off
+	switch whence {
+	case io.SeekStart:
+		off = 0
+	case io.SeekEnd:
+		off = f.size
+	}
+	off += offset
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.off = off
+	return f.off, nil
+}
+
+// flush compresses the spool into the file. content which isn't smaller by
+// compression is stored as it is, unless it looks like the header.
+func (f *compressFile) flush() error {
+	codec := f.c.codec
+	n := (f.size + compressChunkSize - 1) / compressChunkSize
+	index := make([]byte, 4*n)
+	chunks, err := ioutil.TempFile("", "davfs")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(chunks.Name())
+	defer chunks.Close()
+
+	buf := make([]byte, compressChunkSize)
+	total := int64(compressHeaderSize) + 4*n
+	for i := int64(0); i < n; i++ {
+		l, err := f.spool.ReadAt(buf, i*compressChunkSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		b, err := codec.compress(buf[:l])
+		if err != nil {
+			return err
+		}
+		if _, err = chunks.Write(b); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(index[4*i:], uint32(len(b)))
+		total += int64(len(b))
+	}
+
+	var src io.Reader
+	magic := make([]byte, len(compressMagic))
+	l, _ := f.spool.ReadAt(magic, 0)
+	if total >= f.size && string(magic[:l]) != compressMagic {
+		src = io.NewSectionReader(f.spool, 0, f.size)
+	} else {
+		var hdr [compressHeaderSize]byte
+		copy(hdr[:], compressMagic)
+		hdr[4] = codec.id
+		binary.BigEndian.PutUint32(hdr[8:], compressChunkSize)
+		binary.BigEndian.PutUint64(hdr[12:], uint64(f.size))
+		if _, err = chunks.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		src = io.MultiReader(bytes.NewReader(hdr[:]), bytes.NewReader(index), chunks)
+	}
+
+	w, err := f.c.fs.OpenFile(f.ctx, f.name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, f.perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (f *compressFile) Close() error {
+	err := f.File.Close()
+	if f.spool == nil {
+		return err
+	}
+	defer os.Remove(f.spool.Name())
+	defer f.spool.Close()
+	if err != nil {
+		return err
+	}
+	return f.flush()
+}
+
+func (f *compressFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *compressFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
+
+func (f *compressFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil || f.dir {
+		return fi, err
+	}
+	return &sizedInfo{fi, f.size}, nil
+}
@@ -0,0 +1,42 @@
+package davfs
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestCompressHeader(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	c, err := NewCompressFS(fs, "zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("hello, world\n", 10000)
+	putFile(t, c, "/a.txt", content)
+	if s := getFile(t, c, "/a.txt"); s != content {
+		t.Fatalf("got %v bytes", len(s))
+	}
+	fi, err := c.Stat(ctx, "/a.txt")
+	if err != nil || fi.Size() != int64(len(content)) {
+		t.Fatalf("Stat: %v, %v", fi, err)
+	}
+
+	stored := getFile(t, fs, "/a.txt")
+	for _, size := range []uint64{1 << 63, 1 << 40, uint64(len(content)) + compressChunkSize} {
+		b := []byte(stored)
+		binary.BigEndian.PutUint64(b[12:], size)
+		putFile(t, fs, "/bad.txt", string(b))
+		if _, err = c.Stat(ctx, "/bad.txt"); err != os.ErrInvalid {
+			t.Fatalf("Stat with size %v: %v", size, err)
+		}
+		if _, err = c.OpenFile(ctx, "/bad.txt", os.O_RDONLY, 0); err != os.ErrInvalid {
+			t.Fatalf("OpenFile with size %v: %v", size, err)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package davfs
 
 import (
+	"encoding/xml"
+	"net/http"
 	"os"
 
+	"golang.org/x/net/context"
 	"golang.org/x/net/webdav"
 )
 
@@ -11,6 +14,27 @@ type Driver interface {
 	CreateFS(source string) error
 }
 
+// Watcher is implemented by the filesystems which can tell changes made by
+// other instances sharing the same storage.
+type Watcher interface {
+	// Watch calls fn with the name of every changed entry.
+	Watch(fn func(name string)) error
+}
+
+// GarbageCollector is implemented by the filesystems which leave unused
+// data, e.g. unreferenced blobs, to be removed later.
+type GarbageCollector interface {
+	GC(ctx context.Context) error
+}
+
+// Copier is implemented by the filesystems which copy the entry, or the
+// tree, inside the storage without reading the content through davfs. it
+// returns os.ErrExist if newName exists, and ErrNotSupported if the copy
+// can't be done inside the storage, e.g. across mounted filesystems.
+type Copier interface {
+	Copy(ctx context.Context, oldName, newName string) error
+}
+
 var drivers = map[string]Driver{}
 
 func Register(name string, driver Driver) {
@@ -30,3 +54,40 @@ func CreateFS(driver, source string) error {
 	}
 	return os.ErrNotExist
 }
+
+type userKey struct{}
+
+// WithUser returns the context which holds the authenticated user, drivers
+// can get it with UserFromContext.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey{}).(string)
+	return user, ok
+}
+
+// deadProps returns dead properties of the file wrapped by other file, so
+// that wrappers don't hide them from PROPFIND.
+func deadProps(f webdav.File) (map[xml.Name]webdav.Property, error) {
+	if h, ok := f.(webdav.DeadPropsHolder); ok {
+		return h.DeadProps()
+	}
+	return map[xml.Name]webdav.Property{}, nil
+}
+
+// patchProps patches dead properties of the file wrapped by other file.
+// files which don't hold them refuse all patches, as webdav does for them.
+func patchProps(f webdav.File, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if h, ok := f.(webdav.DeadPropsHolder); ok {
+		return h.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
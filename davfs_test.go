@@ -0,0 +1,57 @@
+package davfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func putFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(f, content); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func readNames(t *testing.T, fs webdav.FileSystem, name string) []string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	children, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range children {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,710 @@
+package davfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// encrypted content starts with the header of magic, key ID, chunk size,
+// plaintext size and random file ID, which is followed by the chunks of
+// nonce and sealed plaintext. all chunks but the last have the same size,
+// so reads at any offset open only the chunk. the header and the index of
+// the chunk are authenticated with each chunk, so chunks can't be
+// reordered, truncated or moved to other files.
+const (
+	encryptMagic      = "DAVE"
+	encryptIDSize     = 16
+	encryptHeaderSize = 20 + encryptIDSize
+	encryptChunkSize  = 64 * 1024
+	encryptNonceSize  = 12
+	encryptOverhead   = encryptNonceSize + 16
+
+	// encryptTempPrefix prefixes names of temporary files, to which files
+	// are encrypted before they replace the files.
+	encryptTempPrefix = ".davfs-encrypt-"
+)
+
+var ErrDecrypt = errors.New("davfs: can't decrypt content")
+
+// EncryptFS is the filesystem which encrypts content, and optionally names,
+// of files of other filesystem with AES-GCM. content which doesn't have the
+// header is refused with ErrDecrypt, since anyone who can write the storage
+// could replace it, unless AllowPlain is set to read files written before
+// until Rotate encrypts them. it is not a Usager, so that quotas count
+// plaintext bytes.
+//
+// sizes of files in listings of directories are the stored ones, not to
+// open every file. Stat returns plaintext sizes.
+type EncryptFS struct {
+	// AllowPlain reads content without the header as it is, to migrate
+	// filesystems written without encryption.
+	AllowPlain bool
+
+	fs      webdav.FileSystem
+	keys    map[uint32]cipher.AEAD
+	current uint32
+	names   cipher.AEAD
+	nameMAC []byte
+}
+
+type encryptHeader struct {
+	raw  []byte
+	aead cipher.AEAD
+	size int64
+}
+
+type encryptFile struct {
+	webdav.File
+	e     *EncryptFS
+	ctx   context.Context
+	name  string
+	perm  os.FileMode
+	dir   bool
+	hdr   *encryptHeader
+	size  int64
+	off   int64
+	n     int64
+	buf   []byte
+	spool *os.File
+}
+
+// ParseKeys parses 256-bit keys in hex separated by newlines or commas.
+// lines starting with # are ignored. the last key is used to encrypt, so
+// keys are rotated by appending new one. the key prefixed by "names:" is
+// the key of names, which is kept apart not to change names by rotation.
+func ParseKeys(s string) (keys [][]byte, names []byte, err error) {
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		isNames := strings.HasPrefix(line, "names:")
+		key, err := hex.DecodeString(strings.TrimPrefix(line, "names:"))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(key) != 32 {
+			return nil, nil, errors.New("davfs: key must be 256 bits")
+		}
+		if isNames {
+			names = key
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, nil, errors.New("davfs: no keys")
+	}
+	return keys, names, nil
+}
+
+// keyID returns the ID of the key stored in the header, which is derived
+// from the key, so that keys can be removed in any order.
+func keyID(key []byte) uint32 {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("davfs key id"))
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+// NewEncryptFS returns EncryptFS which encrypts content with the last of
+// keys. names are encrypted with keys derived from the names key if it is
+// not nil.
+func NewEncryptFS(fs webdav.FileSystem, keys [][]byte, names []byte) (*EncryptFS, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("davfs: no keys")
+	}
+	e := &EncryptFS{fs: fs, keys: map[uint32]cipher.AEAD{}}
+	for _, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		e.current = keyID(key)
+		if _, ok := e.keys[e.current]; ok {
+			return nil, errors.New("davfs: duplicate keys")
+		}
+		e.keys[e.current] = aead
+	}
+	if names != nil {
+		// keys for names are derived, not to use the same key with
+		// deterministic nonces and random ones.
+		mac := hmac.New(sha256.New, names)
+		mac.Write([]byte("davfs name key"))
+		aead, err := newAEAD(mac.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		mac = hmac.New(sha256.New, names)
+		mac.Write([]byte("davfs name nonce"))
+		e.names, e.nameMAC = aead, mac.Sum(nil)
+	}
+	return e, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptName encrypts each element of the name. nonces are derived from
+// the elements, so that the same name is always encrypted to the same one
+// to be looked up.
+func (e *EncryptFS) encryptName(name string) string {
+	if e.names == nil || name == "/" {
+		return name
+	}
+	elems := strings.Split(name[1:], "/")
+	for i, elem := range elems {
+		mac := hmac.New(sha256.New, e.nameMAC)
+		mac.Write([]byte(elem))
+		nonce := mac.Sum(nil)[:encryptNonceSize]
+		elems[i] = base64.RawURLEncoding.EncodeToString(e.names.Seal(nonce, nonce, []byte(elem), nil))
+	}
+	return "/" + strings.Join(elems, "/")
+}
+
+func (e *EncryptFS) decryptElem(elem string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(elem)
+	if err != nil || len(b) < encryptNonceSize {
+		return "", ErrDecrypt
+	}
+	plain, err := e.names.Open(nil, b[:encryptNonceSize], b[encryptNonceSize:], nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
+
+func (e *EncryptFS) decryptName(name string) (string, error) {
+	if e.names == nil || name == "/" {
+		return name, nil
+	}
+	elems := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for i, elem := range elems {
+		plain, err := e.decryptElem(elem)
+		if err != nil {
+			return "", err
+		}
+		elems[i] = plain
+	}
+	return "/" + strings.Join(elems, "/"), nil
+}
+
+// encryptedSize returns the stored size of the plaintext size.
+func encryptedSize(size int64) int64 {
+	n := size / encryptChunkSize
+	if size%encryptChunkSize != 0 {
+		n++
+	}
+	return encryptHeaderSize + size + n*encryptOverhead
+}
+
+// readHeader reads the header of encrypted content of the stored size. it
+// returns nil for content which is not encrypted if AllowPlain is set.
+func (e *EncryptFS) readHeader(r io.ReadSeeker, stored int64) (*encryptHeader, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, encryptHeaderSize)
+	_, err := io.ReadFull(r, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && string(b[:4]) != encryptMagic {
+		if e.AllowPlain {
+			return nil, nil
+		}
+		return nil, ErrDecrypt
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, ok := e.keys[binary.BigEndian.Uint32(b[4:])]
+	if !ok || binary.BigEndian.Uint32(b[8:]) != encryptChunkSize {
+		return nil, ErrDecrypt
+	}
+	size := int64(binary.BigEndian.Uint64(b[12:]))
+	if size < 0 || size > stored || encryptedSize(size) != stored {
+		return nil, ErrDecrypt
+	}
+	return &encryptHeader{raw: b, aead: aead, size: size}, nil
+}
+
+// info returns the info with plaintext name and size.
+func (e *EncryptFS) info(ctx context.Context, name string, fi os.FileInfo) (os.FileInfo, error) {
+	if e.names != nil && name != "/" {
+		plain, err := e.decryptElem(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		fi = &namedInfo{fi, plain}
+	}
+	// empty files are being created, which are refused only when opened.
+	if fi.IsDir() || fi.Size() == 0 {
+		return fi, nil
+	}
+	f, err := e.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hdr, err := e.readHeader(f, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if hdr == nil {
+		return fi, nil
+	}
+	return &sizedInfo{fi, hdr.size}, nil
+}
+
+func (e *EncryptFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	return e.fs.Mkdir(ctx, e.encryptName(name), perm)
+}
+
+func (e *EncryptFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	name = e.encryptName(name)
+	// the file is truncated when it is replaced on Close, not to lose the
+	// content if encryption fails.
+	f, err := e.fs.OpenFile(ctx, name, flag&^os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ef := &encryptFile{File: f, e: e, ctx: ctx, name: name, perm: fi.Mode().Perm(), dir: fi.IsDir(), n: -1}
+	if ef.dir {
+		return ef, nil
+	}
+	if flag&os.O_TRUNC != 0 || flag&os.O_CREATE != 0 && fi.Size() == 0 {
+		// new files are written with the header even if they are empty.
+		if err = ef.load(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else {
+		if ef.hdr, err = e.readHeader(f, fi.Size()); err != nil {
+			f.Close()
+			return nil, err
+		}
+		ef.size = fi.Size()
+		if ef.hdr != nil {
+			ef.size = ef.hdr.size
+		}
+	}
+	if flag&os.O_APPEND != 0 {
+		ef.off = ef.size
+	}
+	return ef, nil
+}
+
+func (e *EncryptFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	return e.fs.RemoveAll(ctx, e.encryptName(name))
+}
+
+func (e *EncryptFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	return e.fs.Rename(ctx, e.encryptName(oldName), e.encryptName(newName))
+}
+
+// Copy copies encrypted content as it is, which is not bound to the name.
+func (e *EncryptFS) Copy(ctx context.Context, oldName, newName string) error {
+	c, ok := e.fs.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	return c.Copy(ctx, e.encryptName(oldName), e.encryptName(newName))
+}
+
+func (e *EncryptFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	name = e.encryptName(name)
+	fi, err := e.fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info(ctx, name, fi)
+}
+
+// Rotate encrypts the files under the name with the current key, which are
+// encrypted with other keys, or not encrypted if AllowPlain is set, so that
+// old keys can be removed. each file is replaced after it is encrypted.
+func (e *EncryptFS) Rotate(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	fi, err := e.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		f, err := e.OpenFile(ctx, name, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		ef := f.(*encryptFile)
+		if ef.hdr == nil || ef.hdr.aead != e.keys[e.current] {
+			if err = ef.load(); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		return f.Close()
+	}
+
+	f, err := e.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, fi := range children {
+		if err = e.Rotate(ctx, path.Join(name, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Watch notifies plaintext names. names which can't be decrypted are
+// notified as the root, and temporary files as their directories.
+func (e *EncryptFS) Watch(fn func(name string)) error {
+	w, ok := e.fs.(Watcher)
+	if !ok {
+		return nil
+	}
+	return w.Watch(func(name string) {
+		if strings.HasPrefix(path.Base(name), encryptTempPrefix) {
+			name = path.Dir(name)
+		}
+		plain, err := e.decryptName(name)
+		if err != nil {
+			plain = "/"
+		}
+		fn(plain)
+	})
+}
+
+// aad authenticates the header, which has the file ID, and the index of the
+// chunk.
+func (h *encryptHeader) aad(n int64) []byte {
+	aad := make([]byte, len(h.raw)+8)
+	copy(aad, h.raw)
+	binary.BigEndian.PutUint64(aad[len(h.raw):], uint64(n))
+	return aad
+}
+
+// readAt reads the plaintext at the offset, from the spool if the file is
+// written.
+func (f *encryptFile) readAt(p []byte, off int64) (int, error) {
+	if f.spool != nil {
+		n, err := f.spool.ReadAt(p, off)
+		if n > 0 && err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	if f.hdr == nil {
+		if _, err := f.File.Seek(off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return f.File.Read(p)
+	}
+
+	if off >= f.hdr.size {
+		return 0, io.EOF
+	}
+	n := off / encryptChunkSize
+	if n != f.n {
+		l := f.hdr.size - n*encryptChunkSize
+		if l > encryptChunkSize {
+			l = encryptChunkSize
+		}
+		b := make([]byte, l+encryptOverhead)
+		if _, err := f.File.Seek(encryptHeaderSize+n*(encryptChunkSize+encryptOverhead), io.SeekStart); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(f.File, b); err != nil {
+			return 0, err
+		}
+		buf, err := f.hdr.aead.Open(nil, b[:encryptNonceSize], b[encryptNonceSize:], f.hdr.aad(n))
+		if err != nil {
+			return 0, ErrDecrypt
+		}
+		f.n, f.buf = n, buf
+	}
+	return copy(p, f.buf[off-n*encryptChunkSize:]), nil
+}
+
+// load copies the plaintext to the spool, which is encrypted on Close.
+func (f *encryptFile) load() error {
+	if f.spool != nil {
+		return nil
+	}
+	spool, err := ioutil.TempFile("", "davfs")
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, encryptChunkSize)
+	for off := int64(0); off < f.size; {
+		n, err := f.readAt(buf, off)
+		if n > 0 {
+			if _, err := spool.Write(buf[:n]); err != nil {
+				spool.Close()
+				os.Remove(spool.Name())
+				return err
+			}
+			off += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			return err
+		}
+	}
+	f.spool = spool
+	return nil
+}
+
+func (f *encryptFile) Read(p []byte) (int, error) {
+	if f.dir {
+		return 0, os.ErrInvalid
+	}
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *encryptFile) Write(p []byte) (int, error) {
+	if f.dir {
+		return 0, os.ErrInvalid
+	}
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	n, err := f.spool.WriteAt(p, f.off)
+	f.off += int64(n)
+	if f.off > f.size {
+		f.size = f.off
+	}
+	return n, err
+}
+
+func (f *encryptFile) Seek(offset int64, whence int) (int64, error) {
+	if f.dir {
+		return f.File.Seek(offset, whence)
+	}
+	off := f.off
+	switch whence {
+	case io.SeekStart:
+		off = 0
+	case io.SeekEnd:
+		off = f.size
+	}
+	off += offset
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.off = off
+	return f.off, nil
+}
+
+// flush encrypts the spool with the current key into the temporary file,
+// which replaces the file with the dead properties of it.
+func (f *encryptFile) flush(props map[xml.Name]webdav.Property) error {
+	hdr := &encryptHeader{raw: make([]byte, encryptHeaderSize), aead: f.e.keys[f.e.current], size: f.size}
+	copy(hdr.raw, encryptMagic)
+	binary.BigEndian.PutUint32(hdr.raw[4:], f.e.current)
+	binary.BigEndian.PutUint32(hdr.raw[8:], encryptChunkSize)
+	binary.BigEndian.PutUint64(hdr.raw[12:], uint64(f.size))
+	if _, err := rand.Read(hdr.raw[20:]); err != nil {
+		return err
+	}
+
+	tmp := path.Join(path.Dir(f.name), encryptTempPrefix+hex.EncodeToString(hdr.raw[20:]))
+	w, err := f.e.fs.OpenFile(f.ctx, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, f.perm)
+	if err != nil {
+		return err
+	}
+	if err = f.write(w, hdr); err == nil && len(props) > 0 {
+		patch := webdav.Proppatch{}
+		for _, p := range props {
+			patch.Props = append(patch.Props, p)
+		}
+		_, err = patchProps(w, []webdav.Proppatch{patch})
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = f.e.replace(f.ctx, tmp, f.name)
+	}
+	if err != nil {
+		f.e.fs.RemoveAll(f.ctx, tmp)
+	}
+	return err
+}
+
+// write writes the header and the chunks of the spool.
+func (f *encryptFile) write(w io.Writer, hdr *encryptHeader) error {
+	var buf bytes.Buffer
+	buf.Write(hdr.raw)
+	plain := make([]byte, encryptChunkSize)
+	for n := int64(0); n*encryptChunkSize < f.size; n++ {
+		l, err := f.spool.ReadAt(plain, n*encryptChunkSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		nonce := make([]byte, encryptNonceSize)
+		if _, err = rand.Read(nonce); err != nil {
+			return err
+		}
+		buf.Write(hdr.aead.Seal(nonce, nonce, plain[:l], hdr.aad(n)))
+		if _, err = w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	if buf.Len() > 0 {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace renames the temporary file to the name. filesystems may not
+// rename over existing files, so the file is moved aside, and moved back if
+// the rename fails.
+func (e *EncryptFS) replace(ctx context.Context, tmp, name string) error {
+	old := tmp + "-old"
+	if err := e.fs.Rename(ctx, name, old); err != nil {
+		return err
+	}
+	if err := e.fs.Rename(ctx, tmp, name); err != nil {
+		e.fs.Rename(ctx, old, name)
+		return err
+	}
+	return e.fs.RemoveAll(ctx, old)
+}
+
+func (f *encryptFile) Close() error {
+	if f.spool == nil {
+		return f.File.Close()
+	}
+	defer os.Remove(f.spool.Name())
+	defer f.spool.Close()
+	props, err := deadProps(f.File)
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return f.flush(props)
+}
+
+// Readdir returns the entries with plaintext names. entries whose names
+// can't be decrypted, e.g. written without encryption of names, are skipped
+// since they can't be opened, and so are temporary files.
+func (f *encryptFile) Readdir(count int) ([]os.FileInfo, error) {
+	children, err := f.File.Readdir(count)
+	fis := make([]os.FileInfo, 0, len(children))
+	for _, fi := range children {
+		if strings.HasPrefix(fi.Name(), encryptTempPrefix) {
+			continue
+		}
+		if f.e.names != nil {
+			plain, err := f.e.decryptElem(fi.Name())
+			if err != nil {
+				continue
+			}
+			fi = &namedInfo{fi, plain}
+		}
+		fis = append(fis, fi)
+	}
+	if err == nil && count > 0 && len(children) > 0 && len(fis) == 0 {
+		return f.Readdir(count)
+	}
+	return fis, err
+}
+
+func (f *encryptFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *encryptFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
+
+func (f *encryptFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if f.e.names != nil && f.name != "/" {
+		plain, err := f.e.decryptElem(fi.Name())
+		if err == nil {
+			fi = &namedInfo{fi, plain}
+		}
+	}
+	if f.dir {
+		return fi, nil
+	}
+	return &sizedInfo{fi, f.size}, nil
+}
@@ -0,0 +1,211 @@
+package davfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptRotate(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	k1, k2, k3, names := newKey(t), newKey(t), newKey(t), newKey(t)
+	content := strings.Repeat("secret", 20000)
+
+	e, err := NewEncryptFS(fs, [][]byte{k1, k2}, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, e, "/dir/a.txt", content)
+
+	// the first key is removed after rotation to the new key.
+	if e, err = NewEncryptFS(fs, [][]byte{k1, k2, k3}, names); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Rotate(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if e, err = NewEncryptFS(fs, [][]byte{k2, k3}, names); err != nil {
+		t.Fatal(err)
+	}
+	if s := getFile(t, e, "/dir/a.txt"); s != content {
+		t.Fatalf("got %v bytes after rotation", len(s))
+	}
+	fi, err := e.Stat(ctx, "/dir/a.txt")
+	if err != nil || fi.Size() != int64(len(content)) {
+		t.Fatalf("Stat: %v, %v", fi, err)
+	}
+
+	// the old key can't read the rotated content.
+	old, err := NewEncryptFS(fs, [][]byte{k2}, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = old.OpenFile(ctx, "/dir/a.txt", os.O_RDONLY, 0); err != ErrDecrypt {
+		t.Fatalf("OpenFile with the removed key: %v", err)
+	}
+}
+
+func TestEncryptSwapChunks(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	e, err := NewEncryptFS(fs, [][]byte{newKey(t)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, e, "/a.txt", strings.Repeat("a", encryptChunkSize*2))
+	putFile(t, e, "/b.txt", strings.Repeat("b", encryptChunkSize*2))
+
+	// the second chunk of b is moved into a.
+	a, b := []byte(getFile(t, fs, "/a.txt")), []byte(getFile(t, fs, "/b.txt"))
+	second := encryptHeaderSize + encryptChunkSize + encryptOverhead
+	copy(a[second:], b[second:])
+	if bytes.Equal(a, []byte(getFile(t, fs, "/a.txt"))) {
+		t.Fatal("chunks are the same")
+	}
+	putFile(t, fs, "/a.txt", string(a))
+
+	f, err := e.OpenFile(ctx, "/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 16)
+	if _, err = f.Seek(encryptChunkSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Read(buf); err != ErrDecrypt {
+		t.Fatalf("Read of moved chunk: %v", err)
+	}
+}
+
+func TestEncryptPlain(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	putFile(t, fs, "/plain.txt", "plain")
+	e, err := NewEncryptFS(fs, [][]byte{newKey(t)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// content without the header is refused unless allowed.
+	if _, err = e.OpenFile(ctx, "/plain.txt", os.O_RDONLY, 0); err != ErrDecrypt {
+		t.Fatalf("OpenFile of plain content: %v", err)
+	}
+	if _, err = e.Stat(ctx, "/plain.txt"); err != ErrDecrypt {
+		t.Fatalf("Stat of plain content: %v", err)
+	}
+	if err = e.Rotate(ctx, "/"); err != ErrDecrypt {
+		t.Fatalf("Rotate of plain content: %v", err)
+	}
+	e.AllowPlain = true
+	if s := getFile(t, e, "/plain.txt"); s != "plain" {
+		t.Fatalf("content with AllowPlain: %q", s)
+	}
+	if err = e.Rotate(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	e.AllowPlain = false
+	if s := getFile(t, e, "/plain.txt"); s != "plain" {
+		t.Fatalf("content after rotation: %q", s)
+	}
+	if s := getFile(t, fs, "/plain.txt"); !strings.HasPrefix(s, encryptMagic) {
+		t.Fatalf("stored content after rotation: %q", s)
+	}
+
+	// content replaced in the storage is refused, and empty files have
+	// the header too.
+	putFile(t, fs, "/plain.txt", "forged")
+	if _, err = e.OpenFile(ctx, "/plain.txt", os.O_RDONLY, 0); err != ErrDecrypt {
+		t.Fatalf("OpenFile of replaced content: %v", err)
+	}
+	putFile(t, e, "/empty.txt", "")
+	if s := getFile(t, e, "/empty.txt"); s != "" {
+		t.Fatalf("content of empty file: %q", s)
+	}
+	if s := getFile(t, fs, "/empty.txt"); len(s) != encryptHeaderSize {
+		t.Fatalf("stored size of empty file: %d", len(s))
+	}
+}
+
+// failingFS fails to create files exclusively, as temporary files are.
+type failingFS struct {
+	webdav.FileSystem
+}
+
+func (fs failingFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&os.O_EXCL != 0 {
+		return nil, ErrQuotaExceeded
+	}
+	return fs.FileSystem.OpenFile(ctx, name, flag, perm)
+}
+
+func TestEncryptFailedClose(t *testing.T) {
+	ctx := context.Background()
+	mem := webdav.NewMemFS()
+	e, err := NewEncryptFS(mem, [][]byte{newKey(t)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, e, "/a.txt", "old")
+	f, err := e.OpenFile(ctx, "/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prop := webdav.Property{XMLName: xml.Name{Space: "urn:test", Local: "p"}, InnerXML: []byte("v")}
+	if _, err = f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{Props: []webdav.Property{prop}}}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the file is kept if the new content can't be stored.
+	failing := &EncryptFS{fs: failingFS{mem}, keys: e.keys, current: e.current}
+	if f, err = failing.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_TRUNC, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != ErrQuotaExceeded {
+		t.Fatalf("Close over failing filesystem: %v", err)
+	}
+	if s := getFile(t, e, "/a.txt"); s != "old" {
+		t.Fatalf("content after failed Close: %q", s)
+	}
+
+	// the replaced file keeps dead properties, and no temporary files are
+	// left.
+	putFile(t, e, "/a.txt", "new")
+	if s := getFile(t, e, "/a.txt"); s != "new" {
+		t.Fatalf("content after Close: %q", s)
+	}
+	if f, err = e.OpenFile(ctx, "/a.txt", os.O_RDONLY, 0); err != nil {
+		t.Fatal(err)
+	}
+	props, err := f.(webdav.DeadPropsHolder).DeadProps()
+	f.Close()
+	if err != nil || string(props[prop.XMLName].InnerXML) != "v" {
+		t.Fatalf("dead properties after Close: %v, %v", props, err)
+	}
+	if names := readNames(t, mem, "/"); len(names) != 1 || names[0] != "a.txt" {
+		t.Fatalf("stored entries: %v", names)
+	}
+}
@@ -0,0 +1,469 @@
+package davfs
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// MountFS is the filesystem which routes calls to the filesystems mounted
+// at path prefixes. parent directories of mount points are synthesized,
+// and MOVE between filesystems is done by streaming.
+type MountFS struct {
+	mu     sync.RWMutex
+	mounts map[string]webdav.FileSystem
+}
+
+// namedInfo renames the entry, e.g. root of mounted filesystem.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi *namedInfo) Name() string { return fi.name }
+
+type dirInfo struct {
+	name string
+}
+
+func (fi *dirInfo) Name() string       { return fi.name }
+func (fi *dirInfo) Size() int64        { return 0 }
+func (fi *dirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (fi *dirInfo) ModTime() time.Time { return time.Now() }
+func (fi *dirInfo) IsDir() bool        { return true }
+func (fi *dirInfo) Sys() interface{}   { return nil }
+
+type mountFile struct {
+	webdav.File
+	name     string
+	children []os.FileInfo
+	merged   bool
+	off      int
+}
+
+func NewMountFS() *MountFS {
+	return &MountFS{mounts: map[string]webdav.FileSystem{}}
+}
+
+func cleanName(name string) (string, error) {
+	name = path.Clean(name)
+	if !strings.HasPrefix(name, "/") {
+		return "", os.ErrInvalid
+	}
+	return name, nil
+}
+
+func baseName(name string) string {
+	if name == "/" {
+		return "/"
+	}
+	return path.Base(name)
+}
+
+// Mount mounts fs at prefix.
+func (m *MountFS) Mount(prefix string, fs webdav.FileSystem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix, err := cleanName(prefix)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.mounts[prefix]; ok {
+		return os.ErrExist
+	}
+	m.mounts[prefix] = fs
+	return nil
+}
+
+// Watch calls fn with the names prefixed by mount points for every mounted
+// filesystem which is a Watcher.
+func (m *MountFS) Watch(fn func(name string)) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for prefix, fs := range m.mounts {
+		w, ok := fs.(Watcher)
+		if !ok {
+			continue
+		}
+		prefix := prefix
+		err := w.Watch(func(name string) {
+			fn(path.Join(prefix, name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the filesystem which has the name, and the name in it.
+func (m *MountFS) resolve(name string) (webdav.FileSystem, string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for prefix := name; ; prefix = path.Dir(prefix) {
+		if fs, ok := m.mounts[prefix]; ok {
+			return fs, "/" + strings.TrimPrefix(strings.TrimPrefix(name, prefix), "/")
+		}
+		if prefix == "/" {
+			return nil, ""
+		}
+	}
+}
+
+// mountPoints returns names of the children of the directory which lead
+// to mount points.
+func (m *MountFS) mountPoints(name string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	dir := strings.TrimSuffix(name, "/") + "/"
+	seen := map[string]bool{}
+	var names []string
+	for prefix := range m.mounts {
+		if prefix == name || !strings.HasPrefix(prefix, dir) {
+			continue
+		}
+		child := strings.SplitN(prefix[len(dir):], "/", 2)[0]
+		if !seen[child] {
+			seen[child] = true
+			names = append(names, child)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isMountPoint reports whether the name is mount point or its ancestor,
+// which can't be removed or moved.
+func (m *MountFS) isMountPoint(name string) bool {
+	m.mu.RLock()
+	_, ok := m.mounts[name]
+	m.mu.RUnlock()
+	return ok || len(m.mountPoints(name)) > 0
+}
+
+func (m *MountFS) stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fs, rel := m.resolve(name)
+	if fs != nil {
+		fi, err := fs.Stat(ctx, rel)
+		if err == nil {
+			if rel == "/" {
+				return &namedInfo{fi, baseName(name)}, nil
+			}
+			return fi, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if name == "/" || len(m.mountPoints(name)) > 0 {
+		return &dirInfo{baseName(name)}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *MountFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if m.isMountPoint(name) {
+		return os.ErrExist
+	}
+	fs, rel := m.resolve(name)
+	if fs == nil {
+		return os.ErrPermission
+	}
+	return fs.Mkdir(ctx, rel, perm)
+}
+
+func (m *MountFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []os.FileInfo
+	for _, child := range m.mountPoints(name) {
+		fi, err := m.stat(ctx, path.Join(name, child))
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, fi)
+	}
+
+	fs, rel := m.resolve(name)
+	if fs != nil {
+		f, err := fs.OpenFile(ctx, rel, flag, perm)
+		if err == nil {
+			// roots of mounted filesystems are named by the mount points.
+			if children == nil && rel != "/" {
+				return f, nil
+			}
+			return &mountFile{File: f, name: name, children: children}, nil
+		}
+		if !os.IsNotExist(err) || children == nil {
+			return nil, err
+		}
+	} else if name != "/" && children == nil {
+		return nil, os.ErrNotExist
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	return &mountFile{name: name, children: children}, nil
+}
+
+func (m *MountFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if m.isMountPoint(name) {
+		return os.ErrPermission
+	}
+	fs, rel := m.resolve(name)
+	if fs == nil {
+		return os.ErrNotExist
+	}
+	return fs.RemoveAll(ctx, rel)
+}
+
+// Usage returns usage of the directory if it is in a mounted filesystem
+// which is a Usager, and no mount point is under it.
+func (m *MountFS) Usage(ctx context.Context, name string) (int64, int64, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	fs, rel := m.resolve(name)
+	us, ok := fs.(Usager)
+	if !ok || len(m.mountPoints(name)) > 0 {
+		return 0, 0, ErrNotSupported
+	}
+	return us.Usage(ctx, rel)
+}
+
+// mkdirAll makes the directory and its missing ancestors.
+func mkdirAll(ctx context.Context, fs webdav.FileSystem, name string) error {
+	var dirs []string
+	for dir := name; dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_, err := fs.Stat(ctx, dirs[i])
+		if os.IsNotExist(err) {
+			err = fs.Mkdir(ctx, dirs[i], 0755)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyAll copies the entry between filesystems by streaming.
+func copyAll(ctx context.Context, src webdav.FileSystem, oldName string, dst webdav.FileSystem, newName string) error {
+	fi, err := src.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if err = dst.Mkdir(ctx, newName, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		f, err := src.OpenFile(ctx, oldName, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		children, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			err = copyAll(ctx, src, path.Join(oldName, child.Name()), dst, path.Join(newName, child.Name()))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r, err := src.OpenFile(ctx, oldName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.OpenFile(ctx, newName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (m *MountFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	if m.isMountPoint(oldName) || m.isMountPoint(newName) {
+		return os.ErrPermission
+	}
+	ofs, orel := m.resolve(oldName)
+	nfs, nrel := m.resolve(newName)
+	if ofs == nil || nfs == nil {
+		return os.ErrPermission
+	}
+	if ofs == nfs {
+		return ofs.Rename(ctx, orel, nrel)
+	}
+
+	if _, err = nfs.Stat(ctx, nrel); err == nil {
+		return os.ErrExist
+	}
+	if err = copyAll(ctx, ofs, orel, nfs, nrel); err != nil {
+		return err
+	}
+	return ofs.RemoveAll(ctx, orel)
+}
+
+// Copy copies inside the mounted filesystem. copies across filesystems are
+// not supported.
+func (m *MountFS) Copy(ctx context.Context, oldName, newName string) error {
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	if m.isMountPoint(oldName) || m.isMountPoint(newName) {
+		return ErrNotSupported
+	}
+	ofs, orel := m.resolve(oldName)
+	nfs, nrel := m.resolve(newName)
+	if ofs == nil || nfs == nil {
+		return os.ErrPermission
+	}
+	c, ok := ofs.(Copier)
+	if !ok || ofs != nfs {
+		return ErrNotSupported
+	}
+	return c.Copy(ctx, orel, nrel)
+}
+
+func (m *MountFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	return m.stat(ctx, name)
+}
+
+func (f *mountFile) Read(p []byte) (int, error) {
+	if f.File == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.File.Read(p)
+}
+
+func (f *mountFile) Write(p []byte) (int, error) {
+	if f.File == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.File.Write(p)
+}
+
+func (f *mountFile) Seek(offset int64, whence int) (int64, error) {
+	if f.File == nil {
+		return 0, os.ErrInvalid
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *mountFile) Close() error {
+	if f.File == nil {
+		return nil
+	}
+	return f.File.Close()
+}
+
+func (f *mountFile) Stat() (os.FileInfo, error) {
+	if f.File == nil {
+		return &dirInfo{baseName(f.name)}, nil
+	}
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &namedInfo{fi, baseName(f.name)}, nil
+}
+
+func (f *mountFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *mountFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
+
+// Readdir returns children of the directory, where mount points hide the
+// entries which have same names.
+func (f *mountFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.merged && f.File != nil {
+		fis, err := f.File.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, fi := range f.children {
+			seen[fi.Name()] = true
+		}
+		for _, fi := range fis {
+			if !seen[fi.Name()] {
+				f.children = append(f.children, fi)
+			}
+		}
+		sort.Slice(f.children, func(i, j int) bool {
+			return f.children[i].Name() < f.children[j].Name()
+		})
+	}
+	f.merged = true
+
+	old := f.off
+	if old >= len(f.children) {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	if count > 0 {
+		f.off += count
+		if f.off > len(f.children) {
+			f.off = len(f.children)
+		}
+	} else {
+		f.off = len(f.children)
+		old = 0
+	}
+	return f.children[old:f.off], nil
+}
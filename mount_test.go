@@ -0,0 +1,113 @@
+package davfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestMountRouting(t *testing.T) {
+	ctx := context.Background()
+	root, archive, nested := webdav.NewMemFS(), webdav.NewMemFS(), webdav.NewMemFS()
+	m := NewMountFS()
+	for prefix, fs := range map[string]webdav.FileSystem{"/": root, "/archive": archive, "/a/b": nested} {
+		if err := m.Mount(prefix, fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	putFile(t, m, "/x.txt", "root")
+	putFile(t, m, "/archive/x.txt", "archive")
+	putFile(t, m, "/a/b/x.txt", "nested")
+	if s := getFile(t, archive, "/x.txt"); s != "archive" {
+		t.Fatalf("content in mounted filesystem: %q", s)
+	}
+	if s := getFile(t, nested, "/x.txt"); s != "nested" {
+		t.Fatalf("content in nested mount: %q", s)
+	}
+	if s := getFile(t, m, "/x.txt"); s != "root" {
+		t.Fatalf("content in root: %q", s)
+	}
+
+	if names := strings.Join(readNames(t, m, "/"), ","); names != "a,archive,x.txt" {
+		t.Fatalf("Readdir of root: %v", names)
+	}
+	if fi, err := m.Stat(ctx, "/a"); err != nil || !fi.IsDir() {
+		t.Fatalf("Stat of virtual directory: %v", err)
+	}
+	for _, name := range []string{"/archive", "/a/b"} {
+		f, err := m.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil || fi.Name() != name[strings.LastIndex(name, "/")+1:] {
+			t.Fatalf("Stat of opened mount point %s: %v %v", name, fi, err)
+		}
+	}
+
+	if err := m.RemoveAll(ctx, "/archive"); err != os.ErrPermission {
+		t.Fatalf("RemoveAll of mount point: %v", err)
+	}
+	if err := m.Rename(ctx, "/a", "/c"); err != os.ErrPermission {
+		t.Fatalf("Rename of ancestor of mount point: %v", err)
+	}
+	if err := m.Mkdir(ctx, "/archive", 0755); err != os.ErrExist {
+		t.Fatalf("Mkdir of mount point: %v", err)
+	}
+}
+
+func TestMountRename(t *testing.T) {
+	ctx := context.Background()
+	root, archive := webdav.NewMemFS(), webdav.NewMemFS()
+	m := NewMountFS()
+	if err := m.Mount("/", root); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount("/archive", archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, m, "/dir/a.txt", "a")
+	if err := m.Rename(ctx, "/dir", "/archive/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if s := getFile(t, archive, "/dir/a.txt"); s != "a" {
+		t.Fatalf("content moved across mounts: %q", s)
+	}
+	if _, err := root.Stat(ctx, "/dir"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of moved source: %v", err)
+	}
+
+	putFile(t, m, "/b.txt", "b")
+	if err := m.Rename(ctx, "/b.txt", "/archive/dir/a.txt"); err != os.ErrExist {
+		t.Fatalf("Rename over existing entry of other mount: %v", err)
+	}
+	if err := m.Copy(ctx, "/b.txt", "/archive/b.txt"); err != ErrNotSupported {
+		t.Fatalf("Copy across mounts: %v", err)
+	}
+}
+
+func TestMountWithoutRoot(t *testing.T) {
+	ctx := context.Background()
+	m := NewMountFS()
+	if err := m.Mount("/archive", webdav.NewMemFS()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mkdir(ctx, "/dir", 0755); err != os.ErrPermission {
+		t.Fatalf("Mkdir outside mounts: %v", err)
+	}
+	if _, err := m.OpenFile(ctx, "/x.txt", os.O_RDWR|os.O_CREATE, 0644); err == nil {
+		t.Fatal("OpenFile outside mounts succeeded")
+	}
+	if names := strings.Join(readNames(t, m, "/"), ","); names != "archive" {
+		t.Fatalf("Readdir of root: %v", names)
+	}
+}
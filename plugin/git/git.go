@@ -0,0 +1,717 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nkonev/davfs"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// source is path of the repository with options like below.
+//
+//   /path/to/repo.git?branch=master
+//   /path/to/repo.git?ref=v1.0.0
+//
+// available options are:
+//
+//   branch    branch to serve and commit to, default is master
+//   ref       any revision to serve, the filesystem becomes read-only
+//   readonly  reject writes to the branch
+//
+// every completed write is committed to the branch with the authenticated
+// user as author. the branch is updated without touching worktree and
+// index, so bare repository is preferred.
+
+// keepName is placed in empty directories which git can't hold.
+const keepName = ".gitkeep"
+
+func init() {
+	davfs.Register("git", &Driver{})
+}
+
+type Driver struct {
+}
+
+type FileSystem struct {
+	repo     *git.Repository
+	branch   plumbing.ReferenceName
+	commit   *plumbing.Hash
+	readonly bool
+	mu       sync.Mutex
+	Debug    bool
+}
+
+type FileInfo struct {
+	name     string
+	size     int64
+	mode     os.FileMode
+	mod_time time.Time
+}
+
+type File struct {
+	fs       *FileSystem
+	name     string
+	author   string
+	dir      bool
+	data     []byte
+	dirty    bool
+	writable bool
+	off      int64
+	children []os.FileInfo
+}
+
+func parseSource(source string) (string, map[string]string) {
+	opts := map[string]string{}
+	i := strings.LastIndex(source, "?")
+	if i == -1 {
+		return source, opts
+	}
+	for _, kv := range strings.Split(source[i+1:], "&") {
+		token := strings.SplitN(kv, "=", 2)
+		if len(token) == 2 {
+			opts[token[0]] = token[1]
+		} else {
+			opts[token[0]] = "true"
+		}
+	}
+	return source[:i], opts
+}
+
+func (d *Driver) Mount(source string) (webdav.FileSystem, error) {
+	dir, opts := parseSource(source)
+	// bare repositories are found only without DetectDotGit.
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileSystem{repo: repo, branch: plumbing.ReferenceName("refs/heads/master")}
+	if branch, ok := opts["branch"]; ok {
+		fs.branch = plumbing.ReferenceName("refs/heads/" + branch)
+	}
+	if ref, ok := opts["ref"]; ok {
+		if fs.commit, err = repo.ResolveRevision(plumbing.Revision(ref)); err != nil {
+			return nil, err
+		}
+		fs.readonly = true
+	}
+	if readonly, ok := opts["readonly"]; ok {
+		if fs.readonly, err = strconv.ParseBool(readonly); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+func (d *Driver) CreateFS(source string) error {
+	dir, _ := parseSource(source)
+	_, err := git.PlainInit(dir, true)
+	return err
+}
+
+func clearName(name string) (string, error) {
+	name = path.Clean(name)
+	if !strings.HasPrefix(name, "/") {
+		return "", os.ErrInvalid
+	}
+	return name, nil
+}
+
+// head returns the commit served now. it returns nil for the branch which
+// doesn't have any commit yet.
+func (fs *FileSystem) head() (*object.Commit, error) {
+	h := fs.commit
+	if h == nil {
+		ref, err := fs.repo.Reference(fs.branch, true)
+		if err == plumbing.ErrReferenceNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hash := ref.Hash()
+		h = &hash
+	}
+	return fs.repo.CommitObject(*h)
+}
+
+func fileMode(m filemode.FileMode) os.FileMode {
+	switch m {
+	case filemode.Dir:
+		return os.ModeDir | 0755
+	case filemode.Executable:
+		return 0755
+	case filemode.Symlink:
+		return os.ModeSymlink | 0777
+	}
+	return 0644
+}
+
+func (fs *FileSystem) entryInfo(name string, e *object.TreeEntry, mod_time time.Time) (os.FileInfo, error) {
+	fi := &FileInfo{name: name, mode: fileMode(e.Mode), mod_time: mod_time}
+	if !fi.IsDir() {
+		blob, err := fs.repo.BlobObject(e.Hash)
+		if err != nil {
+			return nil, err
+		}
+		fi.size = blob.Size
+	}
+	return fi, nil
+}
+
+func (fs *FileSystem) stat(name string) (os.FileInfo, error) {
+	var err error
+	if name, err = clearName(name); err != nil {
+		return nil, err
+	}
+
+	commit, err := fs.head()
+	if err != nil {
+		return nil, err
+	}
+	if name == "/" {
+		fi := &FileInfo{name: "/", mode: os.ModeDir | 0755, mod_time: time.Now()}
+		if commit != nil {
+			fi.mod_time = commit.Committer.When
+		}
+		return fi, nil
+	}
+	if commit == nil {
+		return nil, os.ErrNotExist
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	e, err := tree.FindEntry(name[1:])
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	return fs.entryInfo(e.Name, e, commit.Committer.When)
+}
+
+// sortEntries sorts tree entries in git order, which compares directories
+// as if they have / suffix.
+func sortEntries(entries []object.TreeEntry) {
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
+}
+
+// update returns hash of the tree which has entry at elems. entry nil
+// removes it. directories become empty are kept with keepName.
+func (fs *FileSystem) update(h plumbing.Hash, elems []string, entry *object.TreeEntry) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	if !h.IsZero() {
+		tree, err := fs.repo.TreeObject(h)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, tree.Entries...)
+	}
+
+	i := 0
+	for i < len(entries) && entries[i].Name != elems[0] {
+		i++
+	}
+
+	var e *object.TreeEntry
+	if len(elems) == 1 {
+		e = entry
+		if e != nil {
+			e.Name = elems[0]
+		}
+	} else {
+		sub := plumbing.ZeroHash
+		if i < len(entries) {
+			if entries[i].Mode != filemode.Dir {
+				return plumbing.ZeroHash, os.ErrInvalid
+			}
+			sub = entries[i].Hash
+		} else if entry == nil {
+			return plumbing.ZeroHash, os.ErrNotExist
+		}
+		sub, err := fs.update(sub, elems[1:], entry)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		e = &object.TreeEntry{Name: elems[0], Mode: filemode.Dir, Hash: sub}
+	}
+
+	if i < len(entries) {
+		entries = append(entries[:i], entries[i+1:]...)
+	}
+	if e != nil {
+		entries = append(entries, *e)
+	}
+	if len(entries) == 0 && entry == nil {
+		keep, err := fs.blob(nil)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: keepName, Mode: filemode.Regular, Hash: keep})
+	}
+	sortEntries(entries)
+
+	obj := fs.repo.Storer.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return fs.repo.Storer.SetEncodedObject(obj)
+}
+
+func (fs *FileSystem) blob(data []byte) (plumbing.Hash, error) {
+	obj := fs.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err = w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return fs.repo.Storer.SetEncodedObject(obj)
+}
+
+// commitChanges applies the changes to the tree of head, and moves the
+// branch to the new commit.
+func (fs *FileSystem) commitChanges(author, message string, changes map[string]*object.TreeEntry) error {
+	head, err := fs.head()
+	if err != nil {
+		return err
+	}
+	root := plumbing.ZeroHash
+	var parents []plumbing.Hash
+	if head != nil {
+		root = head.TreeHash
+		parents = append(parents, head.Hash)
+	}
+
+	// removals go first, so that entry can be moved into removed place.
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (changes[names[i]] == nil) != (changes[names[j]] == nil) {
+			return changes[names[i]] == nil
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if root, err = fs.update(root, strings.Split(name[1:], "/"), changes[name]); err != nil {
+			return err
+		}
+	}
+
+	if author == "" {
+		author = "davfs"
+	}
+	sig := object.Signature{Name: author, Email: author, When: time.Now()}
+	commit := &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      message,
+		TreeHash:     root,
+		ParentHashes: parents,
+	}
+	obj := fs.repo.Storer.NewEncodedObject()
+	if err = commit.Encode(obj); err != nil {
+		return err
+	}
+	h, err := fs.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+
+	var old *plumbing.Reference
+	if head != nil {
+		old = plumbing.NewHashReference(fs.branch, head.Hash)
+	}
+	return fs.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(fs.branch, h), old)
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Mkdir %v", name)
+	}
+
+	if fs.readonly {
+		return os.ErrPermission
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return err
+	}
+	if _, err = fs.stat(name); err == nil {
+		return os.ErrExist
+	}
+	dir, _ := path.Split(name)
+	if di, err := fs.stat(dir); err != nil || !di.IsDir() {
+		return os.ErrNotExist
+	}
+
+	keep, err := fs.blob(nil)
+	if err != nil {
+		return err
+	}
+	user, _ := davfs.UserFromContext(ctx)
+	return fs.commitChanges(user, fmt.Sprintf("Create %s", name), map[string]*object.TreeEntry{
+		path.Join(name, keepName): {Mode: filemode.Regular, Hash: keep},
+	})
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.OpenFile %v", name)
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return nil, err
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0
+	if writable && fs.readonly {
+		return nil, os.ErrPermission
+	}
+
+	fi, err := fs.stat(name)
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&os.O_CREATE != 0 {
+		// based directory should be exists.
+		dir, _ := path.Split(name)
+		if di, err := fs.stat(dir); err != nil || !di.IsDir() {
+			return nil, os.ErrInvalid
+		}
+		if exists && flag&os.O_EXCL != 0 {
+			return nil, os.ErrExist
+		}
+	} else if !exists {
+		return nil, os.ErrNotExist
+	}
+
+	user, _ := davfs.UserFromContext(ctx)
+	f := &File{fs: fs, name: name, author: user, writable: writable}
+	if exists && fi.IsDir() {
+		if writable {
+			return nil, os.ErrInvalid
+		}
+		f.dir = true
+		return f, nil
+	}
+
+	if exists && flag&os.O_TRUNC == 0 {
+		commit, err := fs.head()
+		if err != nil {
+			return nil, err
+		}
+		file, err := commit.File(name[1:])
+		if err != nil {
+			return nil, err
+		}
+		r, err := file.Reader()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		if f.data, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	}
+	// new or truncated file is committed on Close even if nothing is written.
+	f.dirty = writable && (!exists || flag&os.O_TRUNC != 0)
+	return f, nil
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.RemoveAll %v", name)
+	}
+
+	if fs.readonly {
+		return os.ErrPermission
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return err
+	}
+	if name == "/" {
+		return os.ErrInvalid
+	}
+	if _, err = fs.stat(name); err != nil {
+		return err
+	}
+
+	user, _ := davfs.UserFromContext(ctx)
+	return fs.commitChanges(user, fmt.Sprintf("Remove %s", name), map[string]*object.TreeEntry{
+		name: nil,
+	})
+}
+
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Rename %v %v", oldName, newName)
+	}
+
+	if fs.readonly {
+		return os.ErrPermission
+	}
+
+	var err error
+	if oldName, err = clearName(oldName); err != nil {
+		return err
+	}
+	if newName, err = clearName(newName); err != nil {
+		return err
+	}
+	if oldName == "/" || newName == "/" || strings.HasPrefix(newName, oldName+"/") {
+		return os.ErrInvalid
+	}
+	if _, err = fs.stat(newName); err == nil {
+		return os.ErrExist
+	}
+	dir, _ := path.Split(newName)
+	if di, err := fs.stat(dir); err != nil || !di.IsDir() {
+		return os.ErrNotExist
+	}
+
+	commit, err := fs.head()
+	if err != nil {
+		return err
+	}
+	if commit == nil {
+		return os.ErrNotExist
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	e, err := tree.FindEntry(oldName[1:])
+	if err != nil {
+		return os.ErrNotExist
+	}
+
+	// the tree or the blob is moved as is.
+	user, _ := davfs.UserFromContext(ctx)
+	return fs.commitChanges(user, fmt.Sprintf("Move %s to %s", oldName, newName), map[string]*object.TreeEntry{
+		oldName: nil,
+		newName: {Mode: e.Mode, Hash: e.Hash},
+	})
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Stat %v", name)
+	}
+
+	return fs.stat(name)
+}
+
+func (fi *FileInfo) Name() string       { return fi.name }
+func (fi *FileInfo) Size() int64        { return fi.size }
+func (fi *FileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *FileInfo) ModTime() time.Time { return fi.mod_time }
+func (fi *FileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *FileInfo) Sys() interface{}   { return nil }
+
+func (f *File) Write(p []byte) (int, error) {
+	if f.fs.Debug {
+		log.Printf("File.Write %v", f.name)
+	}
+
+	if f.dir || !f.writable {
+		return 0, os.ErrInvalid
+	}
+	if end := f.off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[f.off:], p)
+	f.off += int64(len(p))
+	f.dirty = true
+	return len(p), nil
+}
+
+func (f *File) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.Debug {
+		log.Printf("File.Close %v", f.name)
+	}
+
+	if !f.dirty {
+		return nil
+	}
+	f.dirty = false
+
+	h, err := f.fs.blob(f.data)
+	if err != nil {
+		return err
+	}
+	return f.fs.commitChanges(f.author, fmt.Sprintf("Update %s", f.name), map[string]*object.TreeEntry{
+		f.name: {Mode: filemode.Regular, Hash: h},
+	})
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if f.fs.Debug {
+		log.Printf("File.Read %v", f.name)
+	}
+
+	if f.dir {
+		return 0, os.ErrInvalid
+	}
+	if f.off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.Debug {
+		log.Printf("File.Readdir %v", f.name)
+	}
+
+	if !f.dir {
+		return nil, os.ErrInvalid
+	}
+
+	if f.children == nil {
+		f.children = []os.FileInfo{}
+		commit, err := f.fs.head()
+		if err != nil {
+			return nil, err
+		}
+		if commit != nil {
+			tree, err := commit.Tree()
+			if err != nil {
+				return nil, err
+			}
+			if f.name != "/" {
+				if tree, err = tree.Tree(f.name[1:]); err != nil {
+					return nil, err
+				}
+			}
+			for i := range tree.Entries {
+				e := &tree.Entries[i]
+				if e.Name == keepName {
+					continue
+				}
+				fi, err := f.fs.entryInfo(e.Name, e, commit.Committer.When)
+				if err != nil {
+					return nil, err
+				}
+				f.children = append(f.children, fi)
+			}
+		}
+	}
+
+	old := f.off
+	if old >= int64(len(f.children)) {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	if count > 0 {
+		f.off += int64(count)
+		if f.off > int64(len(f.children)) {
+			f.off = int64(len(f.children))
+		}
+	} else {
+		f.off = int64(len(f.children))
+		old = 0
+	}
+	return f.children[old:f.off], nil
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.fs.Debug {
+		log.Printf("File.Seek %v %v %v", f.name, offset, whence)
+	}
+
+	if f.dir {
+		return 0, os.ErrInvalid
+	}
+	off := f.off
+	switch whence {
+	case io.SeekStart:
+		off = 0
+	case io.SeekEnd:
+		off = int64(len(f.data))
+	}
+	off += offset
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.off = off
+	return f.off, nil
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.Debug {
+		log.Printf("File.Stat %v", f.name)
+	}
+
+	if f.dirty {
+		_, name := path.Split(f.name)
+		return &FileInfo{name: name, size: int64(len(f.data)), mode: 0644, mod_time: time.Now()}, nil
+	}
+	return f.fs.stat(f.name)
+}
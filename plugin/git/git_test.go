@@ -0,0 +1,222 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nkonev/davfs"
+	"golang.org/x/net/context"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func testFS(t *testing.T, query string) (*FileSystem, string, func()) {
+	dir, err := ioutil.TempDir("", "davfs-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	d := &Driver{}
+	if err = d.CreateFS(dir); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	fs, err := d.Mount(dir + query)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return fs.(*FileSystem), dir, cleanup
+}
+
+func writeFile(t *testing.T, ctx context.Context, fs *FileSystem, name, content string) {
+	f, err := fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCommitPerWrite(t *testing.T) {
+	ctx := davfs.WithUser(context.Background(), "alice")
+	fs, _, cleanup := testFS(t, "")
+	defer cleanup()
+
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, ctx, fs, "/dir/a.txt", "hello")
+	if s := readFile(t, fs, "/dir/a.txt"); s != "hello" {
+		t.Fatalf("got %q", s)
+	}
+
+	head, err := fs.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Author.Name != "alice" || head.Message != "Update /dir/a.txt" {
+		t.Fatalf("head commit: %v %q", head.Author.Name, head.Message)
+	}
+	parent, err := head.Parent(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.Message != "Create /dir" || parent.NumParents() != 0 {
+		t.Fatalf("parent commit: %q %d", parent.Message, parent.NumParents())
+	}
+
+	// reads and unchanged files don't commit.
+	f, err := fs.OpenFile(ctx, "/dir/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if now, err := fs.head(); err != nil || now.Hash != head.Hash {
+		t.Fatalf("head after open without write: %v", err)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	ctx := context.Background()
+	fs, _, cleanup := testFS(t, "")
+	defer cleanup()
+
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, ctx, fs, "/dir/a.txt", "a")
+	if err := fs.RemoveAll(ctx, "/dir/"+keepName); err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the last entry keeps the directory with keepName.
+	if err := fs.RemoveAll(ctx, "/dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Stat(ctx, "/dir"); err != nil || !fi.IsDir() {
+		t.Fatalf("Stat of emptied directory: %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/dir/"+keepName); err != nil {
+		t.Fatalf("Stat of %s: %v", keepName, err)
+	}
+	f, err := fs.OpenFile(ctx, "/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil || len(children) != 0 {
+		t.Fatalf("Readdir of emptied directory: %v %v", children, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	fs, dir, cleanup := testFS(t, "")
+	defer cleanup()
+
+	writeFile(t, ctx, fs, "/a.txt", "v1")
+	head, err := fs.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, ctx, fs, "/a.txt", "v2")
+
+	for _, query := range []string{"?ref=" + head.Hash.String(), "?readonly"} {
+		ro, err := (&Driver{}).Mount(dir + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ro.Mkdir(ctx, "/dir", 0755); err != os.ErrPermission {
+			t.Fatalf("Mkdir with %s: %v", query, err)
+		}
+		if _, err = ro.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_TRUNC, 0); err != os.ErrPermission {
+			t.Fatalf("OpenFile with %s: %v", query, err)
+		}
+		if err = ro.RemoveAll(ctx, "/a.txt"); err != os.ErrPermission {
+			t.Fatalf("RemoveAll with %s: %v", query, err)
+		}
+		if err = ro.Rename(ctx, "/a.txt", "/b.txt"); err != os.ErrPermission {
+			t.Fatalf("Rename with %s: %v", query, err)
+		}
+	}
+
+	ro, err := (&Driver{}).Mount(dir + "?ref=" + head.Hash.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, ro.(*FileSystem), "/a.txt"); s != "v1" {
+		t.Fatalf("content of ref: %q", s)
+	}
+}
+
+// racingStorage moves the branch before commits are stored, like other
+// writers of the repository do.
+type racingStorage struct {
+	*memory.Storage
+	race func()
+}
+
+func (s *racingStorage) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	if obj.Type() == plumbing.CommitObject && s.race != nil {
+		s.race()
+	}
+	return s.Storage.SetEncodedObject(obj)
+}
+
+func TestConflict(t *testing.T) {
+	ctx := context.Background()
+	s := &racingStorage{Storage: memory.NewStorage()}
+	repo, err := git.Init(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FileSystem{repo: repo, branch: plumbing.Master}
+
+	writeFile(t, ctx, fs, "/a.txt", "v1")
+	first, err := fs.head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, ctx, fs, "/a.txt", "v2")
+
+	s.race = func() {
+		s.Storage.SetReference(plumbing.NewHashReference(plumbing.Master, first.Hash))
+	}
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("v3"))
+	if err = f.Close(); err == nil {
+		t.Fatal("Close over moved branch succeeded")
+	}
+	s.race = nil
+	if s := readFile(t, fs, "/a.txt"); s != "v1" {
+		t.Fatalf("content after conflict: %q", s)
+	}
+}
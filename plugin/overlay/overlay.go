@@ -0,0 +1,547 @@
+package overlay
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nkonev/davfs"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// source is list of layers separated by ; like below.
+//
+//   sqlite3:upper.db;file:/path/to/templates
+//
+// first layer is the upper layer which takes all writes, the others are
+// read-only lower layers in order of priority. like overlayfs, deleted
+// entries of lower layers are hidden by whiteout files, and directories
+// made over deleted ones are marked as opaque.
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueName     = ".wh..wh..opq"
+)
+
+func init() {
+	davfs.Register("overlay", &Driver{})
+}
+
+type Driver struct {
+}
+
+type FileSystem struct {
+	upper  webdav.FileSystem
+	lowers []webdav.FileSystem
+	mu     sync.Mutex
+	Debug  bool
+}
+
+type File struct {
+	webdav.File
+	fs       *FileSystem
+	name     string
+	lower    bool
+	off      int64
+	children []os.FileInfo
+}
+
+func parseSource(source string) ([]webdav.FileSystem, error) {
+	var layers []webdav.FileSystem
+	for _, layer := range strings.Split(source, ";") {
+		token := strings.SplitN(layer, ":", 2)
+		if len(token) != 2 {
+			return nil, os.ErrInvalid
+		}
+		fs, err := davfs.NewFS(token[0], token[1])
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, fs)
+	}
+	if len(layers) < 2 {
+		return nil, os.ErrInvalid
+	}
+	return layers, nil
+}
+
+// New returns the filesystem which overlays upper on lowers.
+func New(upper webdav.FileSystem, lowers ...webdav.FileSystem) *FileSystem {
+	return &FileSystem{upper: upper, lowers: lowers}
+}
+
+func (d *Driver) Mount(source string) (webdav.FileSystem, error) {
+	layers, err := parseSource(source)
+	if err != nil {
+		return nil, err
+	}
+	return New(layers[0], layers[1:]...), nil
+}
+
+func (d *Driver) CreateFS(source string) error {
+	// only upper layer is created, lower layers should be ready.
+	token := strings.SplitN(strings.SplitN(source, ";", 2)[0], ":", 2)
+	if len(token) != 2 {
+		return os.ErrInvalid
+	}
+	return davfs.CreateFS(token[0], token[1])
+}
+
+func clearName(name string) (string, error) {
+	name = path.Clean(name)
+	if !strings.HasPrefix(name, "/") {
+		return "", os.ErrInvalid
+	}
+	return name, nil
+}
+
+func whiteout(name string) string {
+	dir, base := path.Split(name)
+	return path.Join(dir, whiteoutPrefix+base)
+}
+
+func isSpecial(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+func (fs *FileSystem) exists(ctx context.Context, layer webdav.FileSystem, name string) bool {
+	_, err := layer.Stat(ctx, name)
+	return err == nil
+}
+
+// lowerVisible reports whether lower layers can be seen at the name, that
+// is neither the name nor its ancestors are whited out, and no ancestor is
+// opaque.
+func (fs *FileSystem) lowerVisible(ctx context.Context, name string) bool {
+	p := "/"
+	for _, elem := range strings.Split(strings.Trim(name, "/"), "/") {
+		if elem == "" {
+			break
+		}
+		if fs.exists(ctx, fs.upper, path.Join(p, opaqueName)) {
+			return false
+		}
+		p = path.Join(p, elem)
+		if fs.exists(ctx, fs.upper, whiteout(p)) {
+			return false
+		}
+	}
+	return true
+}
+
+// lookup returns the topmost layer which has the name.
+func (fs *FileSystem) lookup(ctx context.Context, name string) (webdav.FileSystem, os.FileInfo, error) {
+	if isSpecial(name) {
+		return nil, nil, os.ErrNotExist
+	}
+	if fi, err := fs.upper.Stat(ctx, name); err == nil {
+		return fs.upper, fi, nil
+	}
+	if !fs.lowerVisible(ctx, name) {
+		return nil, nil, os.ErrNotExist
+	}
+	for _, lower := range fs.lowers {
+		if fi, err := lower.Stat(ctx, name); err == nil {
+			return lower, fi, nil
+		}
+	}
+	return nil, nil, os.ErrNotExist
+}
+
+// inLower reports whether any lower layer can be seen at the name.
+func (fs *FileSystem) inLower(ctx context.Context, name string) bool {
+	if !fs.lowerVisible(ctx, name) {
+		return false
+	}
+	for _, lower := range fs.lowers {
+		if fs.exists(ctx, lower, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUpDir makes the directory and its ancestors in upper layer.
+func (fs *FileSystem) copyUpDir(ctx context.Context, name string) error {
+	if name == "/" || fs.exists(ctx, fs.upper, name) {
+		return nil
+	}
+	_, fi, err := fs.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return os.ErrInvalid
+	}
+	if err = fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	return fs.upper.Mkdir(ctx, name, fi.Mode().Perm())
+}
+
+func copyFile(ctx context.Context, src webdav.FileSystem, dst webdav.FileSystem, oldName, newName string, perm os.FileMode) error {
+	r, err := src.OpenFile(ctx, oldName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.OpenFile(ctx, newName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// copyUp copies the entry and its descendants into upper layer.
+func (fs *FileSystem) copyUp(ctx context.Context, name string) error {
+	layer, fi, err := fs.lookup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if layer == fs.upper {
+			return nil
+		}
+		if err = fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+			return err
+		}
+		return copyFile(ctx, layer, fs.upper, name, name, fi.Mode().Perm())
+	}
+	if err = fs.copyUpDir(ctx, name); err != nil {
+		return err
+	}
+	children, err := fs.readdir(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err = fs.copyUp(ctx, path.Join(name, child.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readdir returns merged children of the directory.
+func (fs *FileSystem) readdir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	seen := map[string]bool{}
+	children := []os.FileInfo{}
+
+	layers := []webdav.FileSystem{fs.upper}
+	if fs.lowerVisible(ctx, name) && !fs.exists(ctx, fs.upper, path.Join(name, opaqueName)) {
+		layers = append(layers, fs.lowers...)
+	}
+	for _, layer := range layers {
+		f, err := layer.OpenFile(ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		fis, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if layer == fs.upper && strings.HasPrefix(fi.Name(), whiteoutPrefix) {
+				if fi.Name() != opaqueName {
+					seen[fi.Name()[len(whiteoutPrefix):]] = true
+				}
+				continue
+			}
+			if seen[fi.Name()] {
+				continue
+			}
+			seen[fi.Name()] = true
+			children = append(children, fi)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name() < children[j].Name()
+	})
+	return children, nil
+}
+
+// unwhiteout removes the whiteout of the name, and reports whether it
+// existed.
+func (fs *FileSystem) unwhiteout(ctx context.Context, name string) (bool, error) {
+	if !fs.exists(ctx, fs.upper, whiteout(name)) {
+		return false, nil
+	}
+	return true, fs.upper.RemoveAll(ctx, whiteout(name))
+}
+
+// opaque marks the directory in upper layer not to show lower layers.
+func (fs *FileSystem) opaque(ctx context.Context, name string) error {
+	f, err := fs.upper.OpenFile(ctx, path.Join(name, opaqueName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Mkdir %v", name)
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return err
+	}
+	if isSpecial(name) {
+		return os.ErrInvalid
+	}
+	if _, _, err = fs.lookup(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	if err = fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	if err = fs.upper.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	wh, err := fs.unwhiteout(ctx, name)
+	if err != nil {
+		return err
+	}
+	if wh {
+		return fs.opaque(ctx, name)
+	}
+	return nil
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.OpenFile %v", name)
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return nil, err
+	}
+
+	layer, fi, err := fs.lookup(ctx, name)
+	if err != nil && (flag&os.O_CREATE == 0 || isSpecial(name)) {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		f, err := layer.OpenFile(ctx, name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return &File{File: f, fs: fs, name: name, lower: layer != fs.upper}, nil
+		}
+		return f, nil
+	}
+
+	// copy up on write.
+	if err == nil {
+		if fi.IsDir() {
+			return nil, os.ErrInvalid
+		}
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, os.ErrExist
+		}
+		if layer != fs.upper {
+			if flag&os.O_TRUNC == 0 {
+				if err = fs.copyUp(ctx, name); err != nil {
+					return nil, err
+				}
+			}
+			// truncated files of lower layers are made in upper layer.
+			flag |= os.O_CREATE
+		}
+	}
+	if err = fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return nil, err
+	}
+	if _, err = fs.unwhiteout(ctx, name); err != nil {
+		return nil, err
+	}
+	return fs.upper.OpenFile(ctx, name, flag, perm)
+}
+
+func (fs *FileSystem) removeAll(ctx context.Context, name string) error {
+	if _, _, err := fs.lookup(ctx, name); err != nil {
+		return err
+	}
+	lower := fs.inLower(ctx, name)
+	if fs.exists(ctx, fs.upper, name) {
+		if err := fs.upper.RemoveAll(ctx, name); err != nil {
+			return err
+		}
+	}
+	if !lower {
+		return nil
+	}
+	if err := fs.copyUpDir(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := fs.upper.OpenFile(ctx, whiteout(name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.RemoveAll %v", name)
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return err
+	}
+	if name == "/" {
+		return os.ErrInvalid
+	}
+	return fs.removeAll(ctx, name)
+}
+
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Rename %v %v", oldName, newName)
+	}
+
+	var err error
+	if oldName, err = clearName(oldName); err != nil {
+		return err
+	}
+	if newName, err = clearName(newName); err != nil {
+		return err
+	}
+	if oldName == "/" || newName == "/" || isSpecial(newName) {
+		return os.ErrInvalid
+	}
+
+	_, fi, err := fs.lookup(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if _, _, err = fs.lookup(ctx, newName); err == nil {
+		return os.ErrExist
+	}
+
+	// entries of lower layers are copied up to be moved in upper layer.
+	if err = fs.copyUp(ctx, oldName); err != nil {
+		return err
+	}
+	if err = fs.copyUpDir(ctx, path.Dir(newName)); err != nil {
+		return err
+	}
+	wh, err := fs.unwhiteout(ctx, newName)
+	if err != nil {
+		return err
+	}
+	if err = fs.upper.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if wh && fi.IsDir() {
+		if err = fs.opaque(ctx, newName); err != nil {
+			return err
+		}
+	}
+	if fs.inLower(ctx, oldName) {
+		return fs.removeAll(ctx, oldName)
+	}
+	return nil
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Stat %v", name)
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return nil, err
+	}
+	_, fi, err := fs.lookup(ctx, name)
+	return fi, err
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.fs.Debug {
+		log.Printf("File.Readdir %v", f.name)
+	}
+
+	if f.children == nil {
+		children, err := f.fs.readdir(context.Background(), f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.children = children
+	}
+
+	old := f.off
+	if old >= int64(len(f.children)) {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	if count > 0 {
+		f.off += int64(count)
+		if f.off > int64(len(f.children)) {
+			f.off = int64(len(f.children))
+		}
+	} else {
+		f.off = int64(len(f.children))
+		old = 0
+	}
+	return f.children[old:f.off], nil
+}
+
+func (f *File) DeadProps() (map[xml.Name]webdav.Property, error) {
+	if h, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return h.DeadProps()
+	}
+	return map[xml.Name]webdav.Property{}, nil
+}
+
+// Patch patches dead properties of directories in upper layer. lower layers
+// are never written, so patches of their directories are refused.
+func (f *File) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if h, ok := f.File.(webdav.DeadPropsHolder); ok && !f.lower {
+		return h.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
@@ -0,0 +1,230 @@
+package overlay
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func writeFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func readNames(t *testing.T, fs webdav.FileSystem, name string) []string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	children, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range children {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func testFS(t *testing.T) (*FileSystem, webdav.FileSystem, webdav.FileSystem) {
+	ctx := context.Background()
+	upper, lower := webdav.NewMemFS(), webdav.NewMemFS()
+	if err := lower.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, lower, "/dir/a.txt", "lower")
+	if err := lower.Mkdir(ctx, "/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, lower, "/dir/sub/b.txt", "b")
+	return New(upper, lower), upper, lower
+}
+
+func TestCopyUp(t *testing.T) {
+	ctx := context.Background()
+	fs, upper, lower := testFS(t)
+
+	f, err := fs.OpenFile(ctx, "/dir/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("UP")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/dir/a.txt"); s != "UPwer" {
+		t.Fatalf("content of copied up file: %q", s)
+	}
+	if s := readFile(t, upper, "/dir/a.txt"); s != "UPwer" {
+		t.Fatalf("content in upper layer: %q", s)
+	}
+	if s := readFile(t, lower, "/dir/a.txt"); s != "lower" {
+		t.Fatalf("content in lower layer: %q", s)
+	}
+
+	// truncated files are made in upper layer without O_CREATE.
+	if f, err = fs.OpenFile(ctx, "/dir/sub/b.txt", os.O_RDWR|os.O_TRUNC, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/dir/sub/b.txt"); s != "new" {
+		t.Fatalf("content of truncated file: %q", s)
+	}
+	if s := readFile(t, lower, "/dir/sub/b.txt"); s != "b" {
+		t.Fatalf("content in lower layer: %q", s)
+	}
+
+	if _, err = fs.OpenFile(ctx, "/dir/a.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err != os.ErrExist {
+		t.Fatalf("OpenFile with O_EXCL: %v", err)
+	}
+}
+
+func TestWhiteout(t *testing.T) {
+	ctx := context.Background()
+	fs, upper, _ := testFS(t)
+
+	if err := fs.RemoveAll(ctx, "/dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(ctx, "/dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of removed file: %v", err)
+	}
+	if _, err := upper.Stat(ctx, "/dir/"+whiteoutPrefix+"a.txt"); err != nil {
+		t.Fatalf("Stat of whiteout: %v", err)
+	}
+	if names := readNames(t, fs, "/dir"); len(names) != 1 || names[0] != "sub" {
+		t.Fatalf("Readdir after remove: %v", names)
+	}
+
+	writeFile(t, fs, "/dir/a.txt", "again")
+	if s := readFile(t, fs, "/dir/a.txt"); s != "again" {
+		t.Fatalf("content of re-created file: %q", s)
+	}
+	if _, err := upper.Stat(ctx, "/dir/"+whiteoutPrefix+"a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of whiteout after re-create: %v", err)
+	}
+}
+
+func TestOpaque(t *testing.T) {
+	ctx := context.Background()
+	fs, _, lower := testFS(t)
+
+	if err := fs.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if names := readNames(t, fs, "/dir"); len(names) != 0 {
+		t.Fatalf("Readdir of opaque directory: %v", names)
+	}
+	if _, err := fs.Stat(ctx, "/dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of lower file under opaque directory: %v", err)
+	}
+	if _, err := lower.Stat(ctx, "/dir/a.txt"); err != nil {
+		t.Fatalf("Stat in lower layer: %v", err)
+	}
+}
+
+func TestRenameLowerDir(t *testing.T) {
+	ctx := context.Background()
+	fs, _, lower := testFS(t)
+
+	if err := fs.Rename(ctx, "/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(ctx, "/dir"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of renamed directory: %v", err)
+	}
+	if s := readFile(t, fs, "/moved/sub/b.txt"); s != "b" {
+		t.Fatalf("content of moved file: %q", s)
+	}
+	if names := readNames(t, fs, "/"); len(names) != 1 || names[0] != "moved" {
+		t.Fatalf("Readdir of root: %v", names)
+	}
+	if _, err := lower.Stat(ctx, "/dir/sub/b.txt"); err != nil {
+		t.Fatalf("Stat in lower layer: %v", err)
+	}
+}
+
+func TestReaddirPaged(t *testing.T) {
+	ctx := context.Background()
+	fs, upper, lower := testFS(t)
+	for _, name := range []string{"/dir/c.txt", "/dir/e.txt"} {
+		writeFile(t, lower, name, "lower")
+	}
+	if err := upper.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/dir/b.txt", "/dir/c.txt", "/dir/d.txt"} {
+		writeFile(t, upper, name, "upper")
+	}
+
+	f, err := fs.OpenFile(ctx, "/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	for {
+		children, err := f.Readdir(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(children) > 2 {
+			t.Fatalf("page of %d entries", len(children))
+		}
+		for _, fi := range children {
+			names = append(names, fi.Name())
+		}
+	}
+	want := []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "sub"}
+	if len(names) != len(want) {
+		t.Fatalf("Readdir: %v", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("Readdir: %v", names)
+		}
+	}
+	if s := readFile(t, fs, "/dir/c.txt"); s != "upper" {
+		t.Fatalf("content of file in both layers: %q", s)
+	}
+}
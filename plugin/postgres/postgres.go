@@ -1,17 +1,23 @@
 package postgres
 
 import (
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/nkonev/davfs"
 	"golang.org/x/net/context"
 	"golang.org/x/net/webdav"
@@ -27,19 +33,83 @@ create table filesystem(
 );
 
 insert into filesystem(name, content, mode, mod_time) values('/', '', 2147484159, current_timestamp);
+
+create table filesystem_usage(
+	name text not null,
+	bytes bigint not null,
+	files bigint not null,
+	primary key (name)
+);
+
+insert into filesystem_usage(name, bytes, files) values('/', 0, 0);
+`
+
+// createBlobSQL is executed with dedup=true. content of files is the hash
+// of the blob.
+const createBlobSQL = `
+create table filesystem_blob(
+	hash text not null,
+	content text not null,
+	refs bigint not null,
+	primary key (hash)
+);
+`
+
+// createObjectSQL is executed with large_objects=true. content of files is
+// the OID of the large object, and the size of the object is kept here.
+const createObjectSQL = `
+create table filesystem_object(
+	loid text not null,
+	size bigint not null,
+	primary key (loid)
+);
+`
+
+// copyObjectsSQL makes the copied files matching $1 refer new large objects
+// copied from the ones of the originals.
+const copyObjectsSQL = `
+with c as (
+	select name, content, lo_from_bytea(0, lo_get(content::oid))::text as loid from filesystem where name like $1 escape '\' and content <> ''
+), o as (
+	insert into filesystem_object(loid, size) select c.loid, s.size from c join filesystem_object s on s.loid = c.content
+)
+update filesystem f set content = c.loid from c where f.name = c.name
 `
 
+// notifyChannel is the channel which NOTIFY events are sent to on every
+// mutation. payload is the changed name.
+const notifyChannel = "davfs"
+
 func init() {
 	davfs.Register("postgres", &Driver{})
 }
 
+// readAhead is the most bytes of content prefetched by each query of Read,
+// which grows from minReadAhead while reads are sequential, and writeBehind
+// is the bytes of content buffered by Write before updated.
+const (
+	minReadAhead = 64 << 10
+	readAhead    = 4 << 20
+	writeBehind  = 4 << 20
+)
+
 type Driver struct {
+	mu  sync.Mutex
+	dbs map[string]*sql.DB
 }
 
 type FileSystem struct {
-	db    *sql.DB
-	mu    sync.Mutex
-	Debug bool
+	db       *sql.DB
+	table    string
+	source   string
+	mu       sync.Mutex
+	wmu      sync.Mutex
+	watchers []func(name string)
+	listener *pq.Listener
+	hasUsage bool
+	dedup    bool
+	objects  bool
+	Debug    bool
 }
 
 type FileInfo struct {
@@ -50,33 +120,265 @@ type FileInfo struct {
 }
 
 type File struct {
-	fs       *FileSystem
-	name     string
-	off      int64
-	children []os.FileInfo
+	fs      *FileSystem
+	name    string
+	off     int64
+	next    string
+	written bool
+	spool   *os.File
+	buf     []byte
+	bufOff  int64
+	bufEOF  bool
+	ahead   int
+	wbuf    []byte
+	wOff    int64
 }
 
-func (d *Driver) Mount(source string) (webdav.FileSystem, error) {
+// options are the options of davfs in the source, which are removed before
+// the source is passed to the database driver.
+type options struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+	table           string
+	dedup           bool
+	largeObjects    bool
+}
+
+// defaultTable is the table of the filesystem unless table is given.
+// tables are named with the table as the prefix, like filesystem_usage.
+// the table may be qualified by the schema, like davfs.filesystem.
+const defaultTable = "filesystem"
+
+var tablePattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*\.)?[A-Za-z_][A-Za-z0-9_]*$`)
+
+// tableSuffix matches names of the other tables of filesystems, which are
+// refused as the table, so that filesystems sharing a database never share
+// tables.
+var tableSuffix = regexp.MustCompile(`_(usage|blob|object)$`)
+
+// tableSQL returns the query with the tables renamed after table.
+func tableSQL(q, table string) string {
+	if table == defaultTable {
+		return q
+	}
+	return strings.Replace(q, defaultTable, table, -1)
+}
+
+// set sets the option. it returns false if the key is not of davfs.
+func (o *options) set(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "max_open_conns":
+		o.maxOpenConns, err = strconv.Atoi(value)
+	case "max_idle_conns":
+		o.maxIdleConns, err = strconv.Atoi(value)
+	case "conn_max_lifetime":
+		o.connMaxLifetime, err = time.ParseDuration(value)
+	case "conn_max_idle_time":
+		o.connMaxIdleTime, err = time.ParseDuration(value)
+	case "table":
+		if !tablePattern.MatchString(value) || tableSuffix.MatchString(value) {
+			return true, os.ErrInvalid
+		}
+		o.table = value
+	case "dedup":
+		o.dedup, err = strconv.ParseBool(value)
+	case "large_objects":
+		o.largeObjects, err = strconv.ParseBool(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (o *options) apply(db *sql.DB) {
+	if o.maxOpenConns > 0 {
+		db.SetMaxOpenConns(o.maxOpenConns)
+	}
+	if o.maxIdleConns > 0 {
+		db.SetMaxIdleConns(o.maxIdleConns)
+	}
+	if o.connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(o.connMaxLifetime)
+	}
+	if o.connMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(o.connMaxIdleTime)
+	}
+}
+
+// millis returns the duration like 30s in milliseconds. other values are
+// returned as they are.
+func millis(value string) string {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return value
+	}
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+// parseQuery takes the options of davfs out of the query.
+func parseQuery(q url.Values) (*options, error) {
+	opts := &options{table: defaultTable}
+	for key := range q {
+		ok, err := opts.set(key, q.Get(key))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			q.Del(key)
+		}
+	}
+	return opts, nil
+}
+
+// parseSource takes the options of davfs out of the source, which is either
+// a URL or key=value pairs. statement_timeout may be a duration like 30s.
+func parseSource(source string) (string, *options, error) {
+	if strings.HasPrefix(source, "postgres://") || strings.HasPrefix(source, "postgresql://") {
+		u, err := url.Parse(source)
+		if err != nil {
+			return "", nil, err
+		}
+		q := u.Query()
+		opts, err := parseQuery(q)
+		if err != nil {
+			return "", nil, err
+		}
+		if v := q.Get("statement_timeout"); v != "" {
+			q.Set("statement_timeout", millis(v))
+		}
+		u.RawQuery = q.Encode()
+		return u.String(), opts, nil
+	}
+
+	opts := &options{table: defaultTable}
+	var params []string
+	for _, kv := range strings.Fields(source) {
+		token := strings.SplitN(kv, "=", 2)
+		if len(token) == 2 {
+			ok, err := opts.set(token[0], token[1])
+			if err != nil {
+				return "", nil, err
+			}
+			if ok {
+				continue
+			}
+			if token[0] == "statement_timeout" {
+				kv = token[0] + "=" + millis(token[1])
+			}
+		}
+		params = append(params, kv)
+	}
+	return strings.Join(params, " "), opts, nil
+}
+
+// open opens the database with the source of davfs. it returns the source
+// for the database driver.
+func open(source string) (*sql.DB, string, *options, error) {
+	source, opts, err := parseSource(source)
+	if err != nil {
+		return nil, "", nil, err
+	}
 	db, err := sql.Open("postgres", source)
 	if err != nil {
+		return nil, "", nil, err
+	}
+	opts.apply(db)
+	return db, source, opts, nil
+}
+
+// share returns the database opened first for the source, so that the
+// filesystems in other tables of the database, e.g. mounted by -mount,
+// share the connection pool.
+func (d *Driver) share(source string, db *sql.DB) *sql.DB {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if shared, ok := d.dbs[source]; ok {
+		db.Close()
+		return shared
+	}
+	if d.dbs == nil {
+		d.dbs = map[string]*sql.DB{}
+	}
+	d.dbs[source] = db
+	return db
+}
+
+func (d *Driver) Mount(source string) (webdav.FileSystem, error) {
+	db, source, opts, err := open(source)
+	if err != nil {
+		return nil, err
+	}
+	db = d.share(source, db)
+	fs := &FileSystem{db: db, table: opts.table, source: source}
+	// databases created by old versions have no usage counters, and ones
+	// created without dedup=true store content inline. other errors fail.
+	var n int
+	err = fs.queryRow(`select count(*) from filesystem_usage where name = '/'`).Scan(&n)
+	if err != nil && !noTable(err) {
 		return nil, err
 	}
-	return &FileSystem{db: db}, nil
+	fs.hasUsage = err == nil && n > 0
+	err = fs.queryRow(`select count(*) from filesystem_blob where refs < 0`).Scan(&n)
+	if err != nil && !noTable(err) {
+		return nil, err
+	}
+	fs.dedup = err == nil
+	// content is kept in large objects for filesystems created with
+	// large_objects=true, which have the table of objects.
+	err = fs.db.QueryRow(`select to_regclass($1) is not null`, tableSQL("filesystem_object", fs.table)).Scan(&fs.objects)
+	if err != nil {
+		return nil, err
+	}
+	fs.dedup = fs.dedup && !fs.objects
+	return fs, nil
 }
 
 func (d *Driver) CreateFS(source string) error {
-	db, err := sql.Open("postgres", source)
+	db, _, opts, err := open(source)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec(createSQL)
+	if i := strings.Index(opts.table, "."); i != -1 {
+		_, err = db.Exec(`create schema if not exists ` + opts.table[:i])
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(tableSQL(createSQL, opts.table))
 	if err != nil {
 		return err
 	}
+	// content in large objects is not deduplicated.
+	if opts.dedup && !opts.largeObjects {
+		_, err = db.Exec(tableSQL(createBlobSQL, opts.table))
+		if err != nil {
+			return err
+		}
+	}
+	if opts.largeObjects {
+		_, err = db.Exec(tableSQL(createObjectSQL, opts.table))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// noTable reports whether the error is of the missing table.
+func noTable(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && e.Code == "42P01"
+}
+
+// escapeLike escapes the wildcards of like pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
 func clearName(name string) (string, error) {
 	slashed := strings.HasSuffix(name, "/")
 	name = path.Clean(name)
@@ -89,6 +391,134 @@ func clearName(name string) (string, error) {
 	return name, nil
 }
 
+func (fs *FileSystem) exec(q string, args ...interface{}) (sql.Result, error) {
+	return fs.db.Exec(tableSQL(q, fs.table), args...)
+}
+
+func (fs *FileSystem) query(q string, args ...interface{}) (*sql.Rows, error) {
+	return fs.db.Query(tableSQL(q, fs.table), args...)
+}
+
+func (fs *FileSystem) queryRow(q string, args ...interface{}) *sql.Row {
+	return fs.db.QueryRow(tableSQL(q, fs.table), args...)
+}
+
+// channel returns the channel of the table, so that filesystems in other
+// tables of the database don't see the changes.
+func (fs *FileSystem) channel() string {
+	if fs.table == defaultTable {
+		return notifyChannel
+	}
+	return notifyChannel + "_" + fs.table
+}
+
+// notify tells the change to other instances sharing the database.
+func (fs *FileSystem) notify(name string) {
+	_, err := fs.exec(`select pg_notify($1, $2)`, fs.channel(), name)
+	if err != nil && fs.Debug {
+		log.Printf("FileSystem.notify %v: %v", name, err)
+	}
+}
+
+// Watch calls fn with the name changed by any instance sharing the
+// database. fn is called with / after reconnection, because notifications
+// may be lost while disconnected.
+func (fs *FileSystem) Watch(fn func(name string)) error {
+	fs.wmu.Lock()
+	defer fs.wmu.Unlock()
+
+	fs.watchers = append(fs.watchers, fn)
+	if fs.listener != nil {
+		return nil
+	}
+
+	fs.listener = pq.NewListener(fs.source, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if ev == pq.ListenerEventReconnected {
+			fs.changed("/")
+		}
+	})
+	if err := fs.listener.Listen(fs.channel()); err != nil {
+		fs.listener.Close()
+		fs.listener = nil
+		return err
+	}
+	go func(l *pq.Listener) {
+		for n := range l.Notify {
+			// nil is sent after reconnection.
+			if n != nil {
+				fs.changed(n.Extra)
+			}
+		}
+	}(fs.listener)
+	return nil
+}
+
+func (fs *FileSystem) changed(name string) {
+	fs.wmu.Lock()
+	watchers := append([]func(string){}, fs.watchers...)
+	fs.wmu.Unlock()
+
+	for _, fn := range watchers {
+		fn(name)
+	}
+}
+
+// addUsage adds bytes and files to the usage counters of the ancestor
+// directories of the name.
+func (fs *FileSystem) addUsage(name string, bytes, files int64) error {
+	if !fs.hasUsage || name == "/" || (bytes == 0 && files == 0) {
+		return nil
+	}
+	var dirs []string
+	for dir := path.Dir(strings.TrimSuffix(name, "/")); dir != "/"; dir = path.Dir(dir) {
+		dirs = append(dirs, dir+"/")
+	}
+	dirs = append(dirs, "/")
+	_, err := fs.exec(`update filesystem_usage set bytes = bytes + $1, files = files + $2 where name = any($3)`, bytes, files, pq.Array(dirs))
+	return err
+}
+
+// entryUsage returns bytes and files held by the entry, including itself.
+func (fs *FileSystem) entryUsage(name string, fi os.FileInfo) (int64, int64, error) {
+	if !fs.hasUsage {
+		return 0, 0, nil
+	}
+	if !fi.IsDir() {
+		return fi.Size(), 1, nil
+	}
+	var bytes, files int64
+	err := fs.queryRow(`select bytes, files from filesystem_usage where name = $1`, strings.TrimSuffix(name, "/")+"/").Scan(&bytes, &files)
+	if err != nil {
+		return 0, 0, err
+	}
+	return bytes, files + 1, nil
+}
+
+// Usage returns bytes and number of the entries under the directory. these
+// are maintained on every write, so it doesn't sum the content lengths.
+func (fs *FileSystem) Usage(ctx context.Context, name string) (int64, int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Usage %v", name)
+	}
+
+	if !fs.hasUsage {
+		return 0, 0, davfs.ErrNotSupported
+	}
+	var err error
+	if name, err = clearName(name); err != nil {
+		return 0, 0, err
+	}
+	var bytes, files int64
+	err = fs.queryRow(`select bytes, files from filesystem_usage where name = $1`, strings.TrimSuffix(name, "/")+"/").Scan(&bytes, &files)
+	if err == sql.ErrNoRows {
+		return 0, 0, os.ErrNotExist
+	}
+	return bytes, files, err
+}
+
 func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -115,13 +545,26 @@ func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode)
 	for _, elem := range strings.Split(strings.Trim(name, "/"), "/") {
 		base += elem + "/"
 		_, err = fs.stat(base)
+		if err == nil {
+			continue
+		}
 		if err != os.ErrNotExist {
 			return err
 		}
-		_, err = fs.db.Exec(`insert into filesystem(name, content, mode, mod_time) values($1, '', $2, current_timestamp)`, base, perm.Perm()|os.ModeDir)
+		_, err = fs.exec(`insert into filesystem(name, content, mode, mod_time) values($1, '', $2, current_timestamp)`, base, perm.Perm()|os.ModeDir)
 		if err != nil {
 			return err
 		}
+		if fs.hasUsage {
+			_, err = fs.exec(`insert into filesystem_usage(name, bytes, files) values($1, 0, 0)`, base)
+			if err != nil {
+				return err
+			}
+			if err = fs.addUsage(base, 0, 1); err != nil {
+				return err
+			}
+		}
+		fs.notify(base)
 	}
 	return nil
 }
@@ -157,11 +600,15 @@ func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm
 			}
 			fs.removeAll(name)
 		}
-		_, err = fs.db.Exec(`insert into filesystem(name, content, mode, mod_time) values($1, '', $2, current_timestamp)`, name, perm.Perm())
+		_, err = fs.exec(`insert into filesystem(name, content, mode, mod_time) values($1, '', $2, current_timestamp)`, name, perm.Perm())
 		if err != nil {
 			return nil, err
 		}
-		return &File{fs, name, 0, nil}, nil
+		if err = fs.addUsage(name, 0, 1); err != nil {
+			return nil, err
+		}
+		fs.notify(name)
+		return &File{fs: fs, name: name}, nil
 	}
 
 	fi, err := fs.stat(name)
@@ -171,7 +618,22 @@ func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm
 	if !strings.HasSuffix(name, "/") && fi.IsDir() {
 		name += "/"
 	}
-	return &File{fs, name, 0, nil}, nil
+	if flag&os.O_TRUNC != 0 && fs.objects && !fi.IsDir() {
+		// writes don't truncate large objects.
+		_, err = fs.exec(`with o as (delete from filesystem_object where loid = (select content from filesystem where name = $1) returning loid) select lo_unlink(loid::oid) from o`, name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = fs.exec(`update filesystem set content = '', mod_time = current_timestamp where name = $1`, name)
+		if err != nil {
+			return nil, err
+		}
+		if err = fs.addUsage(name, -fi.Size(), 0); err != nil {
+			return nil, err
+		}
+		fs.notify(name)
+	}
+	return &File{fs: fs, name: name}, nil
 }
 
 func (fs *FileSystem) removeAll(name string) error {
@@ -184,13 +646,54 @@ func (fs *FileSystem) removeAll(name string) error {
 	if err != nil {
 		return err
 	}
+	bytes, files, err := fs.entryUsage(name, fi)
+	if err != nil {
+		return err
+	}
+
+	dir := strings.TrimSuffix(name, "/") + "/"
+	if fs.dedup {
+		// blobs which no file refers are removed by GC.
+		if fi.IsDir() {
+			_, err = fs.exec(`update filesystem_blob set refs = refs - (select count(*) from filesystem where content = filesystem_blob.hash and name like $1 escape '\') where hash in (select content from filesystem where name like $1 escape '\')`, escapeLike(dir)+`%`)
+		} else {
+			_, err = fs.exec(`update filesystem_blob set refs = refs - 1 where hash = (select content from filesystem where name = $1)`, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if fs.objects {
+		pattern := escapeLike(name)
+		if fi.IsDir() {
+			pattern = escapeLike(dir) + `%`
+		}
+		_, err = fs.exec(`with o as (delete from filesystem_object where loid in (select content from filesystem where name like $1 escape '\') returning loid) select lo_unlink(loid::oid) from o`, pattern)
+		if err != nil {
+			return err
+		}
+	}
 
 	if fi.IsDir() {
-		_, err = fs.db.Exec(`delete from filesystem where name like $1 escape '\'`, strings.Replace(name, `%`, `\%`, -1)+`%`)
+		_, err = fs.exec(`delete from filesystem where name like $1 escape '\'`, escapeLike(dir)+`%`)
 	} else {
-		_, err = fs.db.Exec(`delete from filesystem where name = $1`, name)
+		_, err = fs.exec(`delete from filesystem where name = $1`, name)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && fs.hasUsage {
+		_, err = fs.exec(`delete from filesystem_usage where name like $1 escape '\'`, escapeLike(dir)+`%`)
+		if err != nil {
+			return err
+		}
+	}
+	if err = fs.addUsage(name, -bytes, -files); err != nil {
+		return err
+	}
+	fs.notify(name)
+	return nil
 }
 
 func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
@@ -224,17 +727,288 @@ func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error
 	if err != nil {
 		return os.ErrExist
 	}
-	if of.IsDir() && !strings.HasSuffix(oldName, "/") {
-		oldName += "/"
-		newName += "/"
+	if of.IsDir() {
+		oldName = strings.TrimSuffix(oldName, "/") + "/"
+		newName = strings.TrimSuffix(newName, "/") + "/"
 	}
 
 	_, err = fs.stat(newName)
 	if err == nil {
 		return os.ErrExist
 	}
+	bytes, files, err := fs.entryUsage(oldName, of)
+	if err != nil {
+		return err
+	}
 
-	_, err = fs.db.Exec(`update filesystem set name = $1 where name = $2`, newName, oldName)
+	if of.IsDir() {
+		// descendants are moved with the directory.
+		_, err = fs.exec(`update filesystem set name = $1 || substr(name, $2) where name like $3 escape '\'`, newName, utf8.RuneCountInString(oldName)+1, escapeLike(oldName)+`%`)
+	} else {
+		_, err = fs.exec(`update filesystem set name = $1 where name = $2`, newName, oldName)
+	}
+	if err != nil {
+		return err
+	}
+	if of.IsDir() && fs.hasUsage {
+		_, err = fs.exec(`update filesystem_usage set name = $1 || substr(name, $2) where name like $3 escape '\'`, newName, utf8.RuneCountInString(oldName)+1, escapeLike(oldName)+`%`)
+		if err != nil {
+			return err
+		}
+	}
+	if err = fs.addUsage(oldName, -bytes, -files); err != nil {
+		return err
+	}
+	if err = fs.addUsage(newName, bytes, files); err != nil {
+		return err
+	}
+	fs.notify(oldName)
+	fs.notify(newName)
+	return nil
+}
+
+// spoolWrite writes to the temporary file, which is stored as a blob on
+// Close.
+func (f *File) spoolWrite(p []byte) (int, error) {
+	if f.spool == nil {
+		spool, err := ioutil.TempFile("", "davfs")
+		if err != nil {
+			return 0, err
+		}
+		if err = f.fs.loadBlob(f.name, spool); err != nil {
+			spool.Close()
+			os.Remove(spool.Name())
+			return 0, err
+		}
+		f.spool = spool
+	}
+	n, err := f.spool.WriteAt(p, f.off)
+	f.off += int64(n)
+	f.written = true
+	return n, err
+}
+
+// storeBlob stores the content as the blob keyed by its SHA-256, and makes
+// the file refer it. empty content refers no blob.
+func (fs *FileSystem) storeBlob(name string, spool *os.File) error {
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := sha256.New()
+	length, err := io.Copy(h, spool)
+	if err != nil {
+		return err
+	}
+	hash := ""
+	if length > 0 {
+		hash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	var old string
+	var size int64
+	err = fs.queryRow(`select f.content, coalesce(length(b.content)/2, 0) from filesystem f left join filesystem_blob b on b.hash = f.content where f.name = $1`, name).Scan(&old, &size)
+	if err != nil {
+		return err
+	}
+	if hash == old {
+		return nil
+	}
+
+	if hash != "" {
+		res, err := fs.exec(`update filesystem_blob set refs = refs + 1 where hash = $1`, hash)
+		if err != nil {
+			return err
+		}
+		// content is sent only if the blob is new.
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			if err = fs.insertBlob(hash, spool); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = fs.exec(`update filesystem set content = $1, mod_time = current_timestamp where name = $2`, hash, name)
+	if err != nil {
+		return err
+	}
+	if old != "" {
+		_, err = fs.exec(`update filesystem_blob set refs = refs - 1 where hash = $1`, old)
+		if err != nil {
+			return err
+		}
+	}
+	return fs.addUsage(name, length-size, 0)
+}
+
+// insertBlob inserts the blob in the transaction, sending the content
+// writeBehind bytes by each statement, so that it is not held in memory at
+// once. the blob inserted by others meanwhile is referred instead.
+func (fs *FileSystem) insertBlob(hash string, spool *os.File) error {
+	tx, err := fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(tableSQL(`insert into filesystem_blob(hash, content, refs) values($1, '', 1) on conflict (hash) do nothing`, fs.table), hash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		_, err = tx.Exec(tableSQL(`update filesystem_blob set refs = refs + 1 where hash = $1`, fs.table), hash)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err = spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	b := make([]byte, writeBehind)
+	for {
+		n, rerr := io.ReadFull(spool, b)
+		if n > 0 {
+			_, err = tx.Exec(tableSQL(`update filesystem_blob set content = content || $1 where hash = $2`, fs.table), hex.EncodeToString(b[:n]), hash)
+			if err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	return tx.Commit()
+}
+
+// loadBlob writes the content of the file in dedup mode to w, readAhead
+// bytes by each query.
+func (fs *FileSystem) loadBlob(name string, w io.Writer) error {
+	for off := int64(0); ; off += readAhead {
+		var content string
+		err := fs.queryRow(`select coalesce(substr(b.content, $1, $2), '') from filesystem f left join filesystem_blob b on b.hash = f.content where f.name = $3`, 1+off*2, readAhead*2, name).Scan(&content)
+		if err != nil {
+			return err
+		}
+		b, err := hex.DecodeString(content)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+		if len(b) < readAhead {
+			return nil
+		}
+	}
+}
+
+// Copy copies the entry by copying rows. blobs are shared by the copies,
+// so content is not copied in dedup mode.
+func (fs *FileSystem) Copy(ctx context.Context, oldName, newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.Copy %v %v", oldName, newName)
+	}
+
+	var err error
+	if oldName, err = clearName(oldName); err != nil {
+		return err
+	}
+	if newName, err = clearName(newName); err != nil {
+		return err
+	}
+
+	of, err := fs.stat(oldName)
+	if err != nil {
+		return err
+	}
+	if _, err = fs.stat(newName); err == nil {
+		return os.ErrExist
+	}
+	dir, _ := path.Split(strings.TrimSuffix(newName, "/"))
+	if _, err = fs.stat(dir); err != nil {
+		return err
+	}
+	bytes, files, err := fs.entryUsage(oldName, of)
+	if err != nil {
+		return err
+	}
+
+	if of.IsDir() {
+		oldName = strings.TrimSuffix(oldName, "/") + "/"
+		newName = strings.TrimSuffix(newName, "/") + "/"
+		if fs.dedup {
+			_, err = fs.exec(`update filesystem_blob set refs = refs + (select count(*) from filesystem where content = filesystem_blob.hash and name like $1 escape '\') where hash in (select content from filesystem where name like $1 escape '\')`, escapeLike(oldName)+`%`)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fs.exec(`insert into filesystem(name, content, mode, mod_time) select $1 || substr(name, $2), content, mode, mod_time from filesystem where name like $3 escape '\'`, newName, utf8.RuneCountInString(oldName)+1, escapeLike(oldName)+`%`)
+		if err != nil {
+			return err
+		}
+		if fs.hasUsage {
+			_, err = fs.exec(`insert into filesystem_usage(name, bytes, files) select $1 || substr(name, $2), bytes, files from filesystem_usage where name like $3 escape '\'`, newName, utf8.RuneCountInString(oldName)+1, escapeLike(oldName)+`%`)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		if fs.dedup {
+			_, err = fs.exec(`update filesystem_blob set refs = refs + 1 where hash = (select content from filesystem where name = $1)`, oldName)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fs.exec(`insert into filesystem(name, content, mode, mod_time) select $1, content, mode, current_timestamp from filesystem where name = $2`, newName, oldName)
+		if err != nil {
+			return err
+		}
+	}
+	if fs.objects {
+		// large objects are not shared by the copies.
+		pattern := escapeLike(newName)
+		if of.IsDir() {
+			pattern += `%`
+		}
+		if _, err = fs.exec(copyObjectsSQL, pattern); err != nil {
+			return err
+		}
+	}
+	if err = fs.addUsage(newName, bytes, files); err != nil {
+		return err
+	}
+	fs.notify(newName)
+	return nil
+}
+
+// GC removes the blobs, or the large objects, which no file refers.
+func (fs *FileSystem) GC(ctx context.Context) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.Debug {
+		log.Printf("FileSystem.GC")
+	}
+
+	if fs.objects {
+		// large objects left by failures.
+		_, err := fs.exec(`with o as (delete from filesystem_object where loid not in (select content from filesystem) returning loid) select lo_unlink(loid::oid) from o`)
+		return err
+	}
+	if !fs.dedup {
+		return nil
+	}
+	_, err := fs.exec(`delete from filesystem_blob where refs <= 0`)
 	return err
 }
 
@@ -244,7 +1018,13 @@ func (fs *FileSystem) stat(name string) (os.FileInfo, error) {
 		return nil, err
 	}
 
-	rows, err := fs.db.Query(`select name, length(content)/2, mode, mod_time from filesystem where name = $1`, name)
+	q := `select name, length(content)/2, mode, mod_time from filesystem where name = $1`
+	if fs.dedup {
+		q = `select f.name, coalesce(length(b.content)/2, 0), f.mode, f.mod_time from filesystem f left join filesystem_blob b on b.hash = f.content where f.name = $1`
+	} else if fs.objects {
+		q = `select f.name, coalesce(o.size, 0), f.mode, f.mod_time from filesystem f left join filesystem_object o on o.loid = f.content where f.name = $1`
+	}
+	rows, err := fs.query(q, name)
 	if err != nil {
 		return nil, err
 	}
@@ -253,7 +1033,7 @@ func (fs *FileSystem) stat(name string) (os.FileInfo, error) {
 		if strings.HasSuffix(name, "/") {
 			return nil, os.ErrNotExist
 		}
-		rows, err = fs.db.Query(`select name, length(content)/2, mode, mod_time from filesystem where name = $1`, name+"/")
+		rows, err = fs.query(q, name+"/")
 		if err != nil {
 			return nil, err
 		}
@@ -301,12 +1081,91 @@ func (f *File) Write(p []byte) (int, error) {
 	if f.fs.Debug {
 		log.Printf("File.Write %v", f.name)
 	}
-	_, err := f.fs.db.Exec(`update filesystem set content = substr(content, 1, $1) || $2 where name = $3`, f.off*2, hex.EncodeToString(p), f.name)
-	if err != nil {
-		return 0, err
+	f.buf = nil
+	if f.fs.dedup {
+		return f.spoolWrite(p)
 	}
+	// sequential writes are buffered to be updated at once.
+	if f.wbuf != nil && f.off != f.wOff+int64(len(f.wbuf)) {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+	if f.wbuf == nil {
+		f.wOff = f.off
+	}
+	f.wbuf = append(f.wbuf, p...)
 	f.off += int64(len(p))
-	return len(p), err
+	f.written = true
+	if len(f.wbuf) >= writeBehind {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flushObject writes the buffered writes into the large object, which is
+// created on the first write. content after them is kept unlike text.
+func (f *File) flushObject() error {
+	var loid string
+	var size int64
+	err := f.fs.queryRow(`select o.loid, o.size from filesystem f join filesystem_object o on o.loid = f.content where f.name = $1`, f.name).Scan(&loid, &size)
+	if err == sql.ErrNoRows {
+		err = f.fs.queryRow(`insert into filesystem_object(loid, size) values(lo_create(0)::text, 0) returning loid`).Scan(&loid)
+		if err == nil {
+			_, err = f.fs.exec(`update filesystem set content = $1 where name = $2`, loid, f.name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.fs.exec(`select lo_put($1::oid, $2, $3)`, loid, f.wOff, f.wbuf)
+	if err != nil {
+		return err
+	}
+	if end := f.wOff + int64(len(f.wbuf)); end > size {
+		_, err = f.fs.exec(`update filesystem_object set size = $1 where loid = $2`, end, loid)
+		if err != nil {
+			return err
+		}
+		if err = f.fs.addUsage(f.name, end-size, 0); err != nil {
+			return err
+		}
+	}
+	_, err = f.fs.exec(`update filesystem set mod_time = current_timestamp where name = $1`, f.name)
+	if err != nil {
+		return err
+	}
+	f.wbuf = nil
+	return nil
+}
+
+// flush updates the content with the buffered writes. content after them
+// is truncated like each Write does.
+func (f *File) flush() error {
+	if f.wbuf == nil {
+		return nil
+	}
+	if f.fs.objects {
+		return f.flushObject()
+	}
+	var size int64
+	if f.fs.hasUsage {
+		err := f.fs.queryRow(`select length(content)/2 from filesystem where name = $1`, f.name).Scan(&size)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := f.fs.exec(`update filesystem set content = substr(content, 1, $1) || $2 where name = $3`, f.wOff*2, hex.EncodeToString(f.wbuf), f.name)
+	if err != nil {
+		return err
+	}
+	if err = f.fs.addUsage(f.name, f.wOff+int64(len(f.wbuf))-size, 0); err != nil {
+		return err
+	}
+	f.wbuf = nil
+	return nil
 }
 
 func (f *File) Close() error {
@@ -314,6 +1173,30 @@ func (f *File) Close() error {
 		log.Printf("File.Close %v", f.name)
 	}
 
+	if spool := f.spool; spool != nil {
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+			f.spool = nil
+		}()
+	}
+	f.fs.mu.Lock()
+	err := f.flush()
+	f.fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if f.spool != nil {
+		f.fs.mu.Lock()
+		err = f.fs.storeBlob(f.name, f.spool)
+		f.fs.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if f.written {
+		f.fs.notify(f.name)
+	}
 	return nil
 }
 
@@ -325,35 +1208,94 @@ func (f *File) Read(p []byte) (int, error) {
 		log.Printf("File.Read %v", f.name)
 	}
 
-	rows, err := f.fs.db.Query(`select mode, substr(content, $1, $2) from filesystem where name = $3`, 1+f.off*2, len(p)*2, f.name)
-	if err != nil {
+	if err := f.flush(); err != nil {
 		return 0, err
 	}
-	defer rows.Close()
+	if f.spool != nil {
+		n, err := f.spool.ReadAt(p, f.off)
+		f.off += int64(n)
+		if n > 0 && err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
 
-	if !rows.Next() {
-		return 0, os.ErrInvalid
+	end := f.bufOff + int64(len(f.buf))
+	if f.buf != nil && f.bufEOF && f.off >= end {
+		return 0, io.EOF
+	}
+	if f.buf == nil || f.off < f.bufOff || f.off >= end {
+		if err := f.prefetch(len(p)); err != nil {
+			return 0, err
+		}
+		if len(f.buf) == 0 {
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, f.buf[f.off-f.bufOff:])
+	f.off += int64(n)
+	return n, nil
+}
+
+// prefetch reads the content from the offset at least n bytes, or the
+// read-ahead bytes, so that following Reads don't query. the read-ahead is
+// doubled when the offset follows the previous prefetch, and reset
+// otherwise, so that random reads don't fetch megabytes.
+func (f *File) prefetch(n int) error {
+	if f.buf != nil && f.off == f.bufOff+int64(len(f.buf)) {
+		f.ahead *= 2
+	} else {
+		f.ahead = minReadAhead
+	}
+	if f.ahead > readAhead {
+		f.ahead = readAhead
+	}
+	if n < f.ahead {
+		n = f.ahead
+	}
+	if f.fs.objects {
+		return f.prefetchObject(n)
+	}
+	q := `select mode, substr(content, $1, $2) from filesystem where name = $3`
+	if f.fs.dedup {
+		q = `select f.mode, coalesce(substr(b.content, $1, $2), '') from filesystem f left join filesystem_blob b on b.hash = f.content where f.name = $3`
 	}
 	var content string
 	var mode os.FileMode
-	err = rows.Scan(&mode, &content)
+	err := f.fs.queryRow(q, 1+f.off*2, n*2, f.name).Scan(&mode, &content)
+	if err == sql.ErrNoRows {
+		return os.ErrInvalid
+	}
 	if err != nil {
-		return 0, err
+		return err
 	}
 	if mode.IsDir() {
-		return 0, os.ErrInvalid
+		return os.ErrInvalid
 	}
 	b, err := hex.DecodeString(content)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	copy(p, b)
-	bl := len(b)
-	f.off += int64(bl)
-	if bl == 0 {
-		return 0, io.EOF
+	f.buf, f.bufOff, f.bufEOF = b, f.off, len(b) < n
+	return nil
+}
+
+// prefetchObject reads the large object from the offset.
+func (f *File) prefetchObject(n int) error {
+	var b []byte
+	var mode os.FileMode
+	err := f.fs.queryRow(`select f.mode, coalesce(lo_get(o.loid::oid, $1, $2), '') from filesystem f left join filesystem_object o on o.loid = f.content where f.name = $3`, f.off, n, f.name).Scan(&mode, &b)
+	if err == sql.ErrNoRows {
+		return os.ErrInvalid
+	}
+	if err != nil {
+		return err
 	}
-	return bl, nil
+	if mode.IsDir() {
+		return os.ErrInvalid
+	}
+	f.buf, f.bufOff, f.bufEOF = b, f.off, len(b) < n
+	return nil
 }
 
 func (f *File) Readdir(count int) ([]os.FileInfo, error) {
@@ -364,49 +1306,50 @@ func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 		log.Printf("File.Readdir %v", f.name)
 	}
 
-	if f.children == nil {
-		rows, err := f.fs.db.Query(`select name from filesystem where name <> $1 and name like $2 escape '\'`, f.name, strings.Replace(f.name, `%`, `\%`, -1)+"%")
+	if !strings.HasSuffix(f.name, "/") {
+		return nil, os.ErrInvalid
+	}
+	// direct children are selected with their stats at once, ordered by
+	// name to be paged from the last name.
+	next := f.next
+	if count <= 0 || next == "" {
+		next = f.name
+	}
+	q := `select name, length(content)/2, mode, mod_time from filesystem where name like $1 escape '\' and name not like $2 escape '\' and name > $3 order by name`
+	if f.fs.dedup {
+		q = `select f.name, coalesce(length(b.content)/2, 0), f.mode, f.mod_time from filesystem f left join filesystem_blob b on b.hash = f.content where f.name like $1 escape '\' and f.name not like $2 escape '\' and f.name > $3 order by f.name`
+	} else if f.fs.objects {
+		q = `select f.name, coalesce(o.size, 0), f.mode, f.mod_time from filesystem f left join filesystem_object o on o.loid = f.content where f.name like $1 escape '\' and f.name not like $2 escape '\' and f.name > $3 order by f.name`
+	}
+	args := []interface{}{escapeLike(f.name) + "%", escapeLike(f.name) + "%/_%", next}
+	if count > 0 {
+		q += ` limit $4`
+		args = append(args, count)
+	}
+	rows, err := f.fs.query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fis := []os.FileInfo{}
+	for rows.Next() {
+		var fi FileInfo
+		err = rows.Scan(&next, &fi.size, &fi.mode, &fi.mod_time)
 		if err != nil {
 			return nil, err
 		}
-		defer rows.Close()
-
-		f.children = []os.FileInfo{}
-		for rows.Next() {
-			var name string
-			err = rows.Scan(&name)
-			if err != nil {
-				return nil, err
-			}
-			part := strings.TrimRight(name[len(f.name):], "/")
-			if strings.IndexRune(part, '/') != -1 {
-				continue
-			}
-			fi, err := f.fs.stat(name)
-			if err != nil {
-				return nil, err
-			}
-			f.children = append(f.children, fi)
-		}
+		_, fi.name = path.Split(path.Clean(next))
+		fis = append(fis, &fi)
 	}
-
-	old := f.off
-	if old >= int64(len(f.children)) {
-		if count > 0 {
-			return nil, io.EOF
-		}
-		return nil, nil
+	if err = rows.Err(); err != nil {
+		return nil, err
 	}
-	if count > 0 {
-		f.off += int64(count)
-		if f.off > int64(len(f.children)) {
-			f.off = int64(len(f.children))
-		}
-	} else {
-		f.off = int64(len(f.children))
-		old = 0
+	f.next = next
+	if count > 0 && len(fis) == 0 {
+		return nil, io.EOF
 	}
-	return f.children[old:f.off], nil
+	return fis, nil
 }
 
 func (f *File) Seek(offset int64, whence int) (int64, error) {
@@ -417,12 +1360,21 @@ func (f *File) Seek(offset int64, whence int) (int64, error) {
 		log.Printf("File.Seek %v %v %v", f.name, offset, whence)
 	}
 
-	var err error
+	err := f.flush()
+	if err != nil {
+		return 0, err
+	}
 	switch whence {
 	case 0:
 		f.off = 0
 	case 2:
-		if fi, err := f.fs.stat(f.name); err != nil {
+		if f.spool != nil {
+			fi, err := f.spool.Stat()
+			if err != nil {
+				return 0, err
+			}
+			f.off = fi.Size()
+		} else if fi, err := f.fs.stat(f.name); err != nil {
 			return 0, err
 		} else {
 			f.off = fi.Size()
@@ -440,5 +1392,19 @@ func (f *File) Stat() (os.FileInfo, error) {
 		log.Printf("File.Stat %v", f.name)
 	}
 
-	return f.fs.stat(f.name)
+	if err := f.flush(); err != nil {
+		return nil, err
+	}
+	fi, err := f.fs.stat(f.name)
+	if err != nil || f.spool == nil {
+		return fi, err
+	}
+	// the size of the content not stored yet.
+	sfi, err := f.spool.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info := *fi.(*FileInfo)
+	info.size = sfi.Size()
+	return &info, nil
 }
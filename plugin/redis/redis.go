@@ -0,0 +1,699 @@
+package redis
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nkonev/davfs"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// source is specified like below.
+//
+//   redis://:password@localhost:6379/0?prefix=davfs&ttl=/scratch=1h,/tmp=10m
+//
+// prefix is used for all keys, so several filesystems can share one
+// database. ttl is comma separated list of path=duration, entries under
+// the path expire after the duration since the last modification of them
+// or their descendants. bare duration is applied to whole filesystem.
+//
+// keys are laid out like below.
+//
+//   <prefix>:meta:<name>     hash of mode, size and mod_time
+//   <prefix>:dir:<name>      set of child names of the directory
+//   <prefix>:data:<name>:<n> n-th chunk of the content
+
+const chunkSize = 64 * 1024
+
+// growScript extends size of the file and updates mod_time atomically.
+var growScript = redis.NewScript(`
+local size = tonumber(redis.call('hget', KEYS[1], 'size') or '0')
+if tonumber(ARGV[1]) > size then
+	redis.call('hset', KEYS[1], 'size', ARGV[1])
+end
+redis.call('hset', KEYS[1], 'mod_time', ARGV[2])
+return 1
+`)
+
+func init() {
+	davfs.Register("redis", &Driver{})
+}
+
+type Driver struct {
+}
+
+type ttlRule struct {
+	name string
+	ttl  time.Duration
+}
+
+type FileSystem struct {
+	client *redis.Client
+	prefix string
+	ttl    []ttlRule
+	Debug  bool
+}
+
+type FileInfo struct {
+	name     string
+	size     int64
+	mode     os.FileMode
+	mod_time time.Time
+}
+
+type File struct {
+	fs       *FileSystem
+	name     string
+	off      int64
+	children []os.FileInfo
+}
+
+func parseSource(source string) (*FileSystem, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileSystem{prefix: "davfs"}
+
+	q := u.Query()
+	if prefix := q.Get("prefix"); prefix != "" {
+		fs.prefix = prefix
+	}
+	if ttl := q.Get("ttl"); ttl != "" {
+		for _, rule := range strings.Split(ttl, ",") {
+			name, value := "/", rule
+			if i := strings.LastIndex(rule, "="); i != -1 {
+				name, value = rule[:i], rule[i+1:]
+			}
+			if name, err = clearName(name); err != nil {
+				return nil, err
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			fs.ttl = append(fs.ttl, ttlRule{name: name, ttl: d})
+		}
+	}
+	// longest path wins.
+	sort.Slice(fs.ttl, func(i, j int) bool {
+		return len(fs.ttl[i].name) > len(fs.ttl[j].name)
+	})
+
+	u.RawQuery = ""
+	opts, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+	fs.client = redis.NewClient(opts)
+	return fs, nil
+}
+
+func (d *Driver) Mount(source string) (webdav.FileSystem, error) {
+	return parseSource(source)
+}
+
+func (d *Driver) CreateFS(source string) error {
+	fs, err := parseSource(source)
+	if err != nil {
+		return err
+	}
+	defer fs.client.Close()
+
+	return fs.client.HMSet(fs.metaKey("/"), map[string]interface{}{
+		"mode":     int64(os.ModeDir | 0777),
+		"size":     0,
+		"mod_time": time.Now().UnixNano(),
+	}).Err()
+}
+
+func clearName(name string) (string, error) {
+	name = path.Clean(name)
+	if !strings.HasPrefix(name, "/") {
+		return "", os.ErrInvalid
+	}
+	return name, nil
+}
+
+func (fs *FileSystem) metaKey(name string) string {
+	return fs.prefix + ":meta:" + name
+}
+
+func (fs *FileSystem) dirKey(name string) string {
+	return fs.prefix + ":dir:" + name
+}
+
+func (fs *FileSystem) chunkKey(name string, n int64) string {
+	return fmt.Sprintf("%s:data:%s:%d", fs.prefix, name, n)
+}
+
+func chunks(size int64) int64 {
+	return (size + chunkSize - 1) / chunkSize
+}
+
+// expiration returns the TTL of the entry, or zero when it should live
+// forever.
+func (fs *FileSystem) expiration(name string) time.Duration {
+	if name == "/" {
+		return 0
+	}
+	for _, rule := range fs.ttl {
+		if rule.name == "/" || strings.HasPrefix(name, rule.name+"/") {
+			return rule.ttl
+		}
+	}
+	return 0
+}
+
+// touch sets expiration of the keys which belong to the entry. keys of the
+// entry which should live forever are persisted, since they may have been
+// moved from the path with TTL.
+func (fs *FileSystem) touch(pipe redis.Pipeliner, name string, keys ...string) {
+	if len(fs.ttl) == 0 {
+		return
+	}
+	ttl := fs.expiration(name)
+	for _, key := range keys {
+		if ttl == 0 {
+			pipe.Persist(key)
+		} else {
+			pipe.Expire(key, ttl)
+		}
+	}
+}
+
+// touchParents refreshes expiration of the directories above the entry, so
+// that they don't expire while their children are still written.
+func (fs *FileSystem) touchParents(pipe redis.Pipeliner, name string) {
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		if ttl := fs.expiration(dir); ttl != 0 {
+			pipe.Expire(fs.metaKey(dir), ttl)
+			pipe.Expire(fs.dirKey(dir), ttl)
+		}
+	}
+}
+
+func (fs *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if fs.Debug {
+		log.Printf("FileSystem.Mkdir %v", name)
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return err
+	}
+
+	_, err = fs.stat(name)
+	if err == nil {
+		return os.ErrExist
+	}
+	if err != os.ErrNotExist {
+		return err
+	}
+
+	dir, base := path.Split(name)
+	dir, _ = clearName(dir)
+	fi, err := fs.stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return os.ErrInvalid
+	}
+
+	_, err = fs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(fs.metaKey(name), map[string]interface{}{
+			"mode":     int64(perm.Perm() | os.ModeDir),
+			"size":     0,
+			"mod_time": time.Now().UnixNano(),
+		})
+		pipe.SAdd(fs.dirKey(dir), base)
+		fs.touch(pipe, name, fs.metaKey(name))
+		fs.touchParents(pipe, name)
+		return nil
+	})
+	return err
+}
+
+func (fs *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if fs.Debug {
+		log.Printf("FileSystem.OpenFile %v", name)
+	}
+
+	var err error
+	if name, err = clearName(name); err != nil {
+		return nil, err
+	}
+
+	fi, err := fs.stat(name)
+	if err != nil && err != os.ErrNotExist {
+		return nil, err
+	}
+	exists := err == nil
+
+	if flag&os.O_CREATE != 0 {
+		// based directory should be exists.
+		dir, base := path.Split(name)
+		dir, _ = clearName(dir)
+		if di, err := fs.stat(dir); err != nil || !di.IsDir() {
+			return nil, os.ErrInvalid
+		}
+		if exists {
+			if flag&os.O_EXCL != 0 {
+				return nil, os.ErrExist
+			}
+			if fi.IsDir() {
+				return nil, os.ErrInvalid
+			}
+		} else {
+			_, err = fs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+				pipe.HMSet(fs.metaKey(name), map[string]interface{}{
+					"mode":     int64(perm.Perm()),
+					"size":     0,
+					"mod_time": time.Now().UnixNano(),
+				})
+				pipe.SAdd(fs.dirKey(dir), base)
+				fs.touch(pipe, name, fs.metaKey(name))
+				fs.touchParents(pipe, name)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			return &File{fs: fs, name: name}, nil
+		}
+	} else if !exists {
+		return nil, os.ErrNotExist
+	}
+
+	if flag&os.O_TRUNC != 0 && !fi.IsDir() {
+		_, err = fs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			for n := int64(0); n < chunks(fi.Size()); n++ {
+				pipe.Del(fs.chunkKey(name, n))
+			}
+			pipe.HMSet(fs.metaKey(name), map[string]interface{}{
+				"size":     0,
+				"mod_time": time.Now().UnixNano(),
+			})
+			fs.touch(pipe, name, fs.metaKey(name))
+			fs.touchParents(pipe, name)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &File{fs: fs, name: name}, nil
+}
+
+// walk returns the entry and all of its descendants.
+func (fs *FileSystem) walk(name string, fi os.FileInfo) (map[string]os.FileInfo, error) {
+	entries := map[string]os.FileInfo{name: fi}
+	if !fi.IsDir() {
+		return entries, nil
+	}
+	children, err := fs.readdir(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		sub, err := fs.walk(path.Join(name, child.Name()), child)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range sub {
+			entries[k] = v
+		}
+	}
+	return entries, nil
+}
+
+func (fs *FileSystem) removeAll(name string) error {
+	var err error
+	if name, err = clearName(name); err != nil {
+		return err
+	}
+	if name == "/" {
+		return os.ErrInvalid
+	}
+
+	fi, err := fs.stat(name)
+	if err != nil {
+		return err
+	}
+	entries, err := fs.walk(name, fi)
+	if err != nil {
+		return err
+	}
+
+	dir, base := path.Split(name)
+	dir, _ = clearName(dir)
+	_, err = fs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for entry, fi := range entries {
+			pipe.Del(fs.metaKey(entry), fs.dirKey(entry))
+			for n := int64(0); n < chunks(fi.Size()); n++ {
+				pipe.Del(fs.chunkKey(entry, n))
+			}
+		}
+		pipe.SRem(fs.dirKey(dir), base)
+		return nil
+	})
+	return err
+}
+
+func (fs *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if fs.Debug {
+		log.Printf("FileSystem.RemoveAll %v", name)
+	}
+
+	return fs.removeAll(name)
+}
+
+func (fs *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if fs.Debug {
+		log.Printf("FileSystem.Rename %v %v", oldName, newName)
+	}
+
+	var err error
+	if oldName, err = clearName(oldName); err != nil {
+		return err
+	}
+	if newName, err = clearName(newName); err != nil {
+		return err
+	}
+	if oldName == "/" || newName == "/" || strings.HasPrefix(newName, oldName+"/") {
+		return os.ErrInvalid
+	}
+
+	of, err := fs.stat(oldName)
+	if err != nil {
+		return err
+	}
+	_, err = fs.stat(newName)
+	if err == nil {
+		return os.ErrExist
+	}
+	newDir, newBase := path.Split(newName)
+	newDir, _ = clearName(newDir)
+	if di, err := fs.stat(newDir); err != nil || !di.IsDir() {
+		return os.ErrNotExist
+	}
+
+	entries, err := fs.walk(oldName, of)
+	if err != nil {
+		return err
+	}
+
+	// sparse files may miss some chunks, and RENAME fails for missing keys.
+	exists := map[string]*redis.IntCmd{}
+	_, err = fs.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for entry, fi := range entries {
+			exists[fs.dirKey(entry)] = pipe.Exists(fs.dirKey(entry))
+			for n := int64(0); n < chunks(fi.Size()); n++ {
+				exists[fs.chunkKey(entry, n)] = pipe.Exists(fs.chunkKey(entry, n))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	oldDir, oldBase := path.Split(oldName)
+	oldDir, _ = clearName(oldDir)
+	_, err = fs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.SRem(fs.dirKey(oldDir), oldBase)
+		pipe.SAdd(fs.dirKey(newDir), newBase)
+		for entry, fi := range entries {
+			moved := newName + entry[len(oldName):]
+			keys := []string{fs.metaKey(moved)}
+			pipe.Rename(fs.metaKey(entry), fs.metaKey(moved))
+			if exists[fs.dirKey(entry)].Val() > 0 {
+				pipe.Rename(fs.dirKey(entry), fs.dirKey(moved))
+				keys = append(keys, fs.dirKey(moved))
+			}
+			for n := int64(0); n < chunks(fi.Size()); n++ {
+				if exists[fs.chunkKey(entry, n)].Val() > 0 {
+					pipe.Rename(fs.chunkKey(entry, n), fs.chunkKey(moved, n))
+					keys = append(keys, fs.chunkKey(moved, n))
+				}
+			}
+			fs.touch(pipe, moved, keys...)
+		}
+		fs.touchParents(pipe, newName)
+		return nil
+	})
+	return err
+}
+
+func (fs *FileSystem) stat(name string) (os.FileInfo, error) {
+	var err error
+	if name, err = clearName(name); err != nil {
+		return nil, err
+	}
+
+	meta, err := fs.client.HGetAll(fs.metaKey(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseMeta(name, meta)
+}
+
+func parseMeta(name string, meta map[string]string) (os.FileInfo, error) {
+	if len(meta) == 0 {
+		return nil, os.ErrNotExist
+	}
+	var fi FileInfo
+	mode, err := strconv.ParseInt(meta["mode"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	fi.mode = os.FileMode(mode)
+	if fi.size, err = strconv.ParseInt(meta["size"], 10, 64); err != nil {
+		return nil, err
+	}
+	mod_time, err := strconv.ParseInt(meta["mod_time"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	fi.mod_time = time.Unix(0, mod_time)
+	_, fi.name = path.Split(name)
+	if fi.name == "" {
+		fi.name = "/"
+	}
+	return &fi, nil
+}
+
+func (fs *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if fs.Debug {
+		log.Printf("FileSystem.Stat %v", name)
+	}
+
+	return fs.stat(name)
+}
+
+func (fi *FileInfo) Name() string       { return fi.name }
+func (fi *FileInfo) Size() int64        { return fi.size }
+func (fi *FileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *FileInfo) ModTime() time.Time { return fi.mod_time }
+func (fi *FileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *FileInfo) Sys() interface{}   { return nil }
+
+func (f *File) Write(p []byte) (int, error) {
+	if f.fs.Debug {
+		log.Printf("File.Write %v", f.name)
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+	keys := []string{f.fs.metaKey(f.name)}
+	_, err := f.fs.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for off, b := f.off, p; len(b) > 0; {
+			n, pos := off/chunkSize, off%chunkSize
+			l := int64(len(b))
+			if l > chunkSize-pos {
+				l = chunkSize - pos
+			}
+			pipe.SetRange(f.fs.chunkKey(f.name, n), pos, string(b[:l]))
+			keys = append(keys, f.fs.chunkKey(f.name, n))
+			off += l
+			b = b[l:]
+		}
+		growScript.Eval(pipe, []string{f.fs.metaKey(f.name)}, f.off+int64(len(p)), time.Now().UnixNano())
+		f.fs.touch(pipe, f.name, keys...)
+		f.fs.touchParents(pipe, f.name)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	f.off += int64(len(p))
+	return len(p), nil
+}
+
+func (f *File) Close() error {
+	if f.fs.Debug {
+		log.Printf("File.Close %v", f.name)
+	}
+
+	return nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if f.fs.Debug {
+		log.Printf("File.Read %v", f.name)
+	}
+
+	fi, err := f.fs.stat(f.name)
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return 0, os.ErrInvalid
+	}
+	if f.off >= fi.Size() {
+		return 0, io.EOF
+	}
+	size := int64(len(p))
+	if size > fi.Size()-f.off {
+		size = fi.Size() - f.off
+	}
+
+	var ranges []*redis.StringCmd
+	_, err = f.fs.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for off, end := f.off, f.off+size; off < end; {
+			n, pos := off/chunkSize, off%chunkSize
+			l := end - off
+			if l > chunkSize-pos {
+				l = chunkSize - pos
+			}
+			ranges = append(ranges, pipe.GetRange(f.fs.chunkKey(f.name, n), pos, pos+l-1))
+			off += l
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	// missing parts of sparse files are read as zero.
+	for i := range p[:size] {
+		p[i] = 0
+	}
+	for off, i := f.off, 0; i < len(ranges); i++ {
+		pos := off % chunkSize
+		l := f.off + size - off
+		if l > chunkSize-pos {
+			l = chunkSize - pos
+		}
+		copy(p[off-f.off:off-f.off+l], ranges[i].Val())
+		off += l
+	}
+	f.off += size
+	return int(size), nil
+}
+
+// readdir returns children of the directory, and forgets the children which
+// have already been expired.
+func (fs *FileSystem) readdir(name string) ([]os.FileInfo, error) {
+	names, err := fs.client.SMembers(fs.dirKey(name)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	metas := make([]*redis.StringStringMapCmd, len(names))
+	_, err = fs.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, base := range names {
+			metas[i] = pipe.HGetAll(fs.metaKey(path.Join(name, base)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	children := []os.FileInfo{}
+	for i, base := range names {
+		fi, err := parseMeta(path.Join(name, base), metas[i].Val())
+		if err == os.ErrNotExist {
+			fs.client.SRem(fs.dirKey(name), base)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, fi)
+	}
+	return children, nil
+}
+
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	if f.fs.Debug {
+		log.Printf("File.Readdir %v", f.name)
+	}
+
+	if f.children == nil {
+		children, err := f.fs.readdir(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.children = children
+	}
+
+	old := f.off
+	if old >= int64(len(f.children)) {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	if count > 0 {
+		f.off += int64(count)
+		if f.off > int64(len(f.children)) {
+			f.off = int64(len(f.children))
+		}
+	} else {
+		f.off = int64(len(f.children))
+		old = 0
+	}
+	return f.children[old:f.off], nil
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if f.fs.Debug {
+		log.Printf("File.Seek %v %v %v", f.name, offset, whence)
+	}
+
+	switch whence {
+	case io.SeekStart:
+		f.off = 0
+	case io.SeekEnd:
+		fi, err := f.fs.stat(f.name)
+		if err != nil {
+			return 0, err
+		}
+		f.off = fi.Size()
+	}
+	f.off += offset
+	return f.off, nil
+}
+
+func (f *File) Stat() (os.FileInfo, error) {
+	if f.fs.Debug {
+		log.Printf("File.Stat %v", f.name)
+	}
+
+	return f.fs.stat(f.name)
+}
@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"golang.org/x/net/context"
+)
+
+func testFS(t *testing.T, query string) (*FileSystem, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Driver{}
+	source := "redis://" + s.Addr() + "/0" + query
+	if err = d.CreateFS(source); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	fs, err := d.Mount(source)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return fs.(*FileSystem), s
+}
+
+func writeFile(t *testing.T, fs *FileSystem, name, content string) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	ctx := context.Background()
+	fs, s := testFS(t, "")
+	defer s.Close()
+
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/dir/a.txt", "hello")
+
+	f, err := fs.OpenFile(ctx, "/dir/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("got %q", b)
+	}
+
+	if err = fs.Rename(ctx, "/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := fs.Stat(ctx, "/moved/a.txt"); err != nil || fi.Size() != 5 {
+		t.Fatalf("Stat of moved file: %v", err)
+	}
+	if err = fs.RemoveAll(ctx, "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat(ctx, "/moved/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of removed file: %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	fs, s := testFS(t, "?ttl=/tmp=1h")
+	defer s.Close()
+
+	if err := fs.Mkdir(ctx, "/tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(ctx, "/tmp/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/tmp/dir/a.txt", "a")
+	if ttl := s.TTL(fs.dirKey("/tmp/dir")); ttl != time.Hour {
+		t.Fatalf("TTL of directory set: %v", ttl)
+	}
+
+	// writes to the child keep the parent alive.
+	s.FastForward(50 * time.Minute)
+	writeFile(t, fs, "/tmp/dir/a.txt", "b")
+	s.FastForward(50 * time.Minute)
+	if _, err := fs.Stat(ctx, "/tmp/dir/a.txt"); err != nil {
+		t.Fatalf("Stat of written file: %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/tmp/dir"); err != nil {
+		t.Fatalf("Stat of parent of written file: %v", err)
+	}
+
+	// entries moved out of the path with TTL live forever.
+	if err := fs.Rename(ctx, "/tmp/dir", "/kept"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{fs.metaKey("/kept"), fs.dirKey("/kept"), fs.metaKey("/kept/a.txt"), fs.chunkKey("/kept/a.txt", 0)} {
+		if ttl := s.TTL(key); ttl != 0 {
+			t.Fatalf("TTL of %v: %v", key, ttl)
+		}
+	}
+
+	s.FastForward(2 * time.Hour)
+	if _, err := fs.Stat(ctx, "/kept/a.txt"); err != nil {
+		t.Fatalf("Stat of moved file: %v", err)
+	}
+	for _, key := range []string{fs.metaKey("/tmp/dir"), fs.dirKey("/tmp"), fs.dirKey("/tmp/dir")} {
+		if s.Exists(key) {
+			t.Fatalf("%v is left", key)
+		}
+	}
+}
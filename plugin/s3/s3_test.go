@@ -0,0 +1,281 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// fakeS3 is the bucket in memory which speaks enough of the S3 API for the
+// client.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+type fakeObject struct {
+	Key          string
+	Size         int64
+	LastModified string
+	ETag         string
+}
+
+type fakePrefix struct {
+	Prefix string
+}
+
+type fakeList struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	KeyCount       int
+	IsTruncated    bool
+	Contents       []fakeObject
+	CommonPrefixes []fakePrefix
+}
+
+type fakeDelete struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type fakeDeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Deleted []struct {
+		Key string
+	}
+}
+
+var fakeTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if token[0] != s.bucket {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	key := ""
+	if len(token) == 2 {
+		key = token[1]
+	}
+
+	switch {
+	case key == "" && r.Method == "GET":
+		s.list(w, r.URL.Query())
+	case key == "" && r.Method == "POST":
+		var req fakeDelete
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var res fakeDeleteResult
+		for _, obj := range req.Objects {
+			delete(s.objects, obj.Key)
+			res.Deleted = append(res.Deleted, struct{ Key string }{obj.Key})
+		}
+		xml.NewEncoder(w).Encode(&res)
+	case r.Method == "PUT":
+		if src := r.Header.Get("x-amz-copy-source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			b, ok := s.objects[strings.TrimPrefix(strings.TrimPrefix(src, "/"), s.bucket+"/")]
+			if !ok {
+				http.Error(w, "", http.StatusNotFound)
+				return
+			}
+			s.objects[key] = b
+			w.Write([]byte("<CopyObjectResult><ETag>\"x\"</ETag></CopyObjectResult>"))
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = b
+		w.Header().Set("ETag", "\"x\"")
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		b, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", "\"x\"")
+		http.ServeContent(w, r, key, fakeTime, bytes.NewReader(b))
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	res := fakeList{Name: s.bucket, Prefix: prefix}
+	prefixes := map[string]bool{}
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 && len(prefix)+i+1 < len(key) {
+				p := key[:len(prefix)+i+1]
+				if !prefixes[p] {
+					prefixes[p] = true
+					res.CommonPrefixes = append(res.CommonPrefixes, fakePrefix{p})
+				}
+				continue
+			}
+		}
+		res.Contents = append(res.Contents, fakeObject{
+			Key:          key,
+			Size:         int64(len(s.objects[key])),
+			LastModified: fakeTime.Format(time.RFC3339),
+			ETag:         "\"x\"",
+		})
+	}
+	res.KeyCount = len(res.Contents) + len(res.CommonPrefixes)
+	xml.NewEncoder(w).Encode(&res)
+}
+
+func testFS(t *testing.T) (webdav.FileSystem, *httptest.Server) {
+	ts := httptest.NewServer(&fakeS3{bucket: "bucket", objects: map[string][]byte{}})
+	fs, err := (&Driver{}).Mount("http://" + ts.Listener.Addr().String() + "/bucket/prefix?region=us-east-1")
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return fs, ts
+}
+
+func writeFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestReadWrite(t *testing.T) {
+	ctx := context.Background()
+	fs, ts := testFS(t)
+	defer ts.Close()
+
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(ctx, "/dir", 0755); !os.IsExist(err) {
+		t.Fatalf("Mkdir of existing directory: %v", err)
+	}
+	writeFile(t, fs, "/dir/a.txt", "hello")
+	if s := readFile(t, fs, "/dir/a.txt"); s != "hello" {
+		t.Fatalf("got %q", s)
+	}
+
+	fi, err := fs.Stat(ctx, "/dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 5 || fi.IsDir() {
+		t.Fatalf("bad info: %v %v", fi.Size(), fi.IsDir())
+	}
+
+	f, err := fs.OpenFile(ctx, "/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 || children[0].Name() != "a.txt" {
+		t.Fatalf("bad children: %v", children)
+	}
+
+	if err = fs.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat(ctx, "/dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of removed file: %v", err)
+	}
+}
+
+func TestCopyRename(t *testing.T) {
+	ctx := context.Background()
+	fs, ts := testFS(t)
+	defer ts.Close()
+	c := fs.(*FileSystem)
+
+	if err := fs.Mkdir(ctx, "/src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/src/a.txt", "a")
+
+	if err := c.Copy(ctx, "/src", "/dst"); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/dst/a.txt"); s != "a" {
+		t.Fatalf("got %q", s)
+	}
+	if err := c.Copy(ctx, "/src", "/dst"); !os.IsExist(err) {
+		t.Fatalf("Copy to existing destination: %v", err)
+	}
+	if err := c.Copy(ctx, "/src/a.txt", "/missing/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Copy to missing parent: %v", err)
+	}
+	if err := fs.Rename(ctx, "/src/a.txt", "/missing/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Rename to missing parent: %v", err)
+	}
+	if err := fs.Rename(ctx, "/src/a.txt", "/src/a.txt/b.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Rename under file: %v", err)
+	}
+
+	if err := fs.Rename(ctx, "/src", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/moved/a.txt"); s != "a" {
+		t.Fatalf("got %q", s)
+	}
+	if _, err := fs.Stat(ctx, "/src"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of renamed directory: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+)
+
+// serve runs SSH server which serves only sftp subsystem of the local
+// filesystem.
+func serve(t *testing.T) net.Listener {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(c, config)
+		}
+	}()
+	return l
+}
+
+func serveConn(c net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				s, err := sftp.NewServer(ch)
+				if err != nil {
+					ch.Close()
+					return
+				}
+				go func() {
+					s.Serve()
+					ch.Close()
+				}()
+			}
+		}()
+	}
+}
+
+func testFS(t *testing.T, query string) (*FileSystem, func()) {
+	l := serve(t)
+	dir, err := ioutil.TempDir("", "davfs-sftp")
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+	fs, err := (&Driver{}).Mount("sftp://user:secret@" + l.Addr().String() + dir + "?insecure=true" + query)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return fs.(*FileSystem), cleanup
+}
+
+func TestReadWrite(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := testFS(t, "")
+	defer cleanup()
+
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.OpenFile(ctx, "/dir/a.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err = fs.OpenFile(ctx, "/dir/a.txt", os.O_RDONLY, 0); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("got %q", b)
+	}
+
+	if err = fs.Rename(ctx, "/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.RemoveAll(ctx, "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat(ctx, "/moved"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of removed directory: %v", err)
+	}
+}
+
+func TestMkdirErrors(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := testFS(t, "")
+	defer cleanup()
+
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != os.ErrExist {
+		t.Fatalf("Mkdir of existing directory: %v", err)
+	}
+	if err := fs.Mkdir(ctx, "/missing/dir", 0755); err != os.ErrNotExist {
+		t.Fatalf("Mkdir under missing directory: %v", err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	fs, cleanup := testFS(t, "&pool=2")
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := fs.Stat(ctx, "/")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, c := range fs.pool.conns {
+		if c == nil {
+			t.Fatalf("connection %v is not dialed", i)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package sqlite3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func testFS(t *testing.T, query string) (*FileSystem, string, func()) {
+	dir, err := ioutil.TempDir("", "davfs-sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	db := filepath.Join(dir, "fs.db")
+	d := &Driver{}
+	if err = d.CreateFS(db + query); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	fs, err := d.Mount(db + query)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return fs.(*FileSystem), db, cleanup
+}
+
+func writeFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs webdav.FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func blobs(t *testing.T, fs *FileSystem) (n, refs int) {
+	err := fs.queryRow(`select count(*), coalesce(sum(refs), 0) from filesystem_blob`).Scan(&n, &refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, refs
+}
+
+func TestStream(t *testing.T) {
+	ctx := context.Background()
+	for _, query := range []string{"", "?dedup=true"} {
+		fs, _, cleanup := testFS(t, query)
+		defer cleanup()
+
+		// larger than the read-ahead and written in small pieces.
+		data := make([]byte, readAhead*3+123)
+		rand.Read(data)
+		f, err := fs.OpenFile(ctx, "/big", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for off := 0; off < len(data); off += 32 << 10 {
+			end := off + 32<<10
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err = f.Write(data[off:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := make([]byte, 10)
+		if _, err = f.Seek(100, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(f, b); err != nil || !bytes.Equal(b, data[100:110]) {
+			t.Fatalf("Read of written file with %q: %v", query, err)
+		}
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if s := readFile(t, fs, "/big"); s != string(data) {
+			t.Fatalf("content with %q: %d bytes", query, len(s))
+		}
+		if f, err = fs.OpenFile(ctx, "/big", os.O_RDONLY, 0); err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int64{int64(len(data)) - 5, readAhead + 7, 3} {
+			if _, err = f.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			n, err := io.ReadFull(f, b)
+			if err != nil && err != io.ErrUnexpectedEOF || !bytes.Equal(b[:n], data[off:off+int64(n)]) {
+				t.Fatalf("Read at %d with %q: %v", off, query, err)
+			}
+		}
+		f.Close()
+		if bytes, _, err := fs.Usage(ctx, "/"); err != nil || bytes != int64(len(data)) {
+			t.Fatalf("Usage with %q: %d, %v", query, bytes, err)
+		}
+
+		// writes out of order are flushed before the gap.
+		if f, err = fs.OpenFile(ctx, "/s", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("hello world"))
+		f.Seek(6, io.SeekStart)
+		f.Write([]byte("W"))
+		f.Write([]byte("orld!"))
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s := readFile(t, fs, "/s"); s != "hello World!" {
+			t.Fatalf("content of file written out of order with %q: %q", query, s)
+		}
+	}
+}
+
+func TestSpoolRemoved(t *testing.T) {
+	ctx := context.Background()
+	fs, _, cleanup := testFS(t, "?dedup=true")
+	defer cleanup()
+
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	spool := f.(*File).spool.Name()
+	if _, err = fs.exec(`drop table filesystem_blob`); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err == nil {
+		t.Fatal("Close without the table of blobs succeeded")
+	}
+	if _, err = os.Stat(spool); !os.IsNotExist(err) {
+		t.Fatalf("Stat of spool after failed Close: %v", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	fs, _, cleanup := testFS(t, "?dedup=true")
+	defer cleanup()
+
+	if err := fs.Mkdir(ctx, "/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(ctx, "/a/b_c", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/a/x", "hello")
+	writeFile(t, fs, "/a/b_c/y", "hello")
+	writeFile(t, fs, "/a/z", "other")
+	if n, refs := blobs(t, fs); n != 2 || refs != 3 {
+		t.Fatalf("%d blobs of %d refs after writes", n, refs)
+	}
+
+	// copies refer to the same blobs.
+	if err := fs.Copy(ctx, "/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/c/b_c/y"); s != "hello" {
+		t.Fatalf("content of copy: %q", s)
+	}
+	if n, refs := blobs(t, fs); n != 2 || refs != 6 {
+		t.Fatalf("%d blobs of %d refs after Copy", n, refs)
+	}
+	if err := fs.RemoveAll(ctx, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "/c/z", "changed")
+	if err := fs.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, refs := blobs(t, fs); n != 2 || refs != 3 {
+		t.Fatalf("%d blobs of %d refs after GC", n, refs)
+	}
+	if fi, err := fs.Stat(ctx, "/c/z"); err != nil || fi.Size() != 7 {
+		t.Fatalf("Stat of rewritten file: %v, %v", fi, err)
+	}
+	if bytes, files, err := fs.Usage(ctx, "/"); err != nil || bytes != 17 || files != 5 {
+		t.Fatalf("Usage: %d bytes, %d files, %v", bytes, files, err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	fs, _, cleanup := testFS(t, "")
+	defer cleanup()
+
+	for _, name := range []string{"/Dir", "/dir", "/dir/sub"} {
+		if err := fs.Mkdir(ctx, name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, fs, "/Dir/a.txt", "A")
+	writeFile(t, fs, "/dir/a.txt", "a")
+	writeFile(t, fs, "/dir/sub/b.txt", "bb")
+
+	if err := fs.Copy(ctx, "/dir", "/copy"); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/copy/sub/b.txt"); s != "bb" {
+		t.Fatalf("content of copy: %q", s)
+	}
+	if s := readFile(t, fs, "/copy/a.txt"); s != "a" {
+		t.Fatalf("content of copy: %q", s)
+	}
+	if bytes, files, err := fs.Usage(ctx, "/copy"); err != nil || bytes != 3 || files != 3 {
+		t.Fatalf("Usage of copy: %d bytes, %d files, %v", bytes, files, err)
+	}
+	if err := fs.Copy(ctx, "/Dir", "/copy"); err != os.ErrExist {
+		t.Fatalf("Copy over existing directory: %v", err)
+	}
+	if err := fs.Copy(ctx, "/none", "/other"); !os.IsNotExist(err) {
+		t.Fatalf("Copy of missing file: %v", err)
+	}
+}
+
+func TestReaddirPaged(t *testing.T) {
+	ctx := context.Background()
+	fs, _, cleanup := testFS(t, "")
+	defer cleanup()
+
+	// siblings with the prefix or wildcards are not listed.
+	for _, name := range []string{"/d", "/d*", "/d/sub"} {
+		if err := fs.Mkdir(ctx, name, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, fs, "/d*/nope", "z")
+	writeFile(t, fs, "/dd", "z")
+	writeFile(t, fs, "/d/sub/deep", "z")
+	for i := 0; i < 25; i++ {
+		writeFile(t, fs, fmt.Sprintf("/d/f%02d", i), "hello")
+	}
+
+	f, err := fs.OpenFile(ctx, "/d", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	for {
+		children, err := f.Readdir(10)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(children) > 10 {
+			t.Fatalf("page of %d entries", len(children))
+		}
+		for _, fi := range children {
+			if !fi.IsDir() && fi.Size() != 5 {
+				t.Fatalf("size of %s: %d", fi.Name(), fi.Size())
+			}
+			names = append(names, fi.Name())
+		}
+	}
+	if len(names) != 26 || names[0] != "f00" || names[25] != "sub" {
+		t.Fatalf("Readdir: %v", names)
+	}
+	children, err := f.Readdir(-1)
+	if err != nil || len(children) != 26 {
+		t.Fatalf("Readdir of all: %d, %v", len(children), err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	source, opts, err := parseSource("fs.db?max_open_conns=4&busy_timeout=10s&synchronous=NORMAL&table=files&dedup=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "fs.db?_busy_timeout=10000&_journal_mode=WAL&_synchronous=NORMAL" {
+		t.Fatalf("source: %s", source)
+	}
+	if opts.maxOpenConns != 4 || opts.table != "files" || !opts.dedup {
+		t.Fatalf("options: %+v", opts)
+	}
+	if source, _, err = parseSource("fs.db?_journal=DELETE"); err != nil || source != "fs.db?_busy_timeout=5000&_journal=DELETE" {
+		t.Fatalf("source with journal: %s, %v", source, err)
+	}
+	if _, _, err = parseSource("fs.db?max_open_conns=x"); err == nil {
+		t.Fatal("invalid max_open_conns is accepted")
+	}
+
+	fs, _, cleanup := testFS(t, "?max_open_conns=2&synchronous=NORMAL")
+	defer cleanup()
+	var mode string
+	var sync int
+	if err = fs.queryRow(`pragma journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("journal_mode: %s, %v", mode, err)
+	}
+	if err = fs.queryRow(`pragma synchronous`).Scan(&sync); err != nil || sync != 1 {
+		t.Fatalf("synchronous: %d, %v", sync, err)
+	}
+	if n := fs.db.Stats().MaxOpenConnections; n != 2 {
+		t.Fatalf("max open connections: %d", n)
+	}
+}
+
+func TestTable(t *testing.T) {
+	ctx := context.Background()
+	a, db, cleanup := testFS(t, "")
+	defer cleanup()
+
+	d := &Driver{}
+	for _, table := range []string{"bad-name", "files_usage", "files_blob", "files_object"} {
+		if err := d.CreateFS(db + "?table=" + table); err != os.ErrInvalid {
+			t.Fatalf("CreateFS with table %s: %v", table, err)
+		}
+	}
+	if err := d.CreateFS(db + "?table=files&dedup=true"); err != nil {
+		t.Fatal(err)
+	}
+	mounted, err := d.Mount(db + "?table=files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := mounted.(*FileSystem)
+	if b.table != "files" || !b.dedup || !b.hasUsage {
+		t.Fatalf("table %s with dedup %v and usage %v", b.table, b.dedup, b.hasUsage)
+	}
+
+	writeFile(t, a, "/x.txt", "aaa")
+	writeFile(t, b, "/x.txt", "bbbbb")
+	if err = b.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, a, "/x.txt"); s != "aaa" {
+		t.Fatalf("content of default table: %q", s)
+	}
+	if s := readFile(t, b, "/x.txt"); s != "bbbbb" {
+		t.Fatalf("content of files: %q", s)
+	}
+	if _, err = a.Stat(ctx, "/dir"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of directory of other table: %v", err)
+	}
+	var n int
+	if err = b.db.QueryRow(`select count(*) from files_blob`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("%d blobs in files_blob: %v", n, err)
+	}
+	if bytes, _, err := b.Usage(ctx, "/"); err != nil || bytes != 5 {
+		t.Fatalf("Usage of files: %d, %v", bytes, err)
+	}
+}
@@ -0,0 +1,190 @@
+package webdav
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// upstream is WebDAV server in memory which counts requests by method.
+type upstream struct {
+	mu      sync.Mutex
+	methods map[string]int
+	h       http.Handler
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.methods[r.Method]++
+	u.mu.Unlock()
+	u.h.ServeHTTP(w, r)
+}
+
+func (u *upstream) count(method string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.methods[method]
+}
+
+func testFS(t *testing.T) (*FileSystem, *upstream, *httptest.Server) {
+	u := &upstream{methods: map[string]int{}, h: &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}}
+	ts := httptest.NewServer(u)
+	fs, err := (&Driver{}).Mount(ts.URL + "/")
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return fs.(*FileSystem), u, ts
+}
+
+func writeFile(t *testing.T, fs *FileSystem, name string, flag int, content string) {
+	f, err := fs.OpenFile(context.Background(), name, flag, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(f, content); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fs *FileSystem, name string) string {
+	f, err := fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestReadWrite(t *testing.T) {
+	ctx := context.Background()
+	fs, _, ts := testFS(t)
+	defer ts.Close()
+
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != os.ErrExist {
+		t.Fatalf("Mkdir of existing directory: %v", err)
+	}
+	writeFile(t, fs, "/dir/a.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "hello")
+	if s := readFile(t, fs, "/dir/a.txt"); s != "hello" {
+		t.Fatalf("got %q", s)
+	}
+
+	f, err := fs.OpenFile(ctx, "/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 || children[0].Name() != "a.txt" || children[0].Size() != 5 {
+		t.Fatalf("bad children: %v", children)
+	}
+
+	if err = fs.Copy(ctx, "/dir", "/copied"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Rename(ctx, "/copied/a.txt", "/dir/a.txt"); err != os.ErrExist {
+		t.Fatalf("Rename to existing file: %v", err)
+	}
+	if err = fs.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/copied/a.txt"); s != "hello" {
+		t.Fatalf("got %q", s)
+	}
+}
+
+func TestOpenWithoutWrite(t *testing.T) {
+	ctx := context.Background()
+	fs, u, ts := testFS(t)
+	defer ts.Close()
+
+	writeFile(t, fs, "/a.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, "hello")
+	gets, puts := u.count("GET"), u.count("PUT")
+
+	// e.g. PROPPATCH opens the file for writing without writes.
+	f, err := fs.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if u.count("GET") != gets || u.count("PUT") != puts {
+		t.Fatalf("content is transferred: %v GET, %v PUT", u.count("GET")-gets, u.count("PUT")-puts)
+	}
+
+	// the first Write spools the content at the offset.
+	f, err = fs.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Seek(1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(f, "EL"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/a.txt"); s != "hELlo" {
+		t.Fatalf("got %q", s)
+	}
+
+	// truncation is sent without writes.
+	f, err = fs.OpenFile(ctx, "/a.txt", os.O_RDWR|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, fs, "/a.txt"); s != "" {
+		t.Fatalf("got %q", s)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	fs, err := (&Driver{}).Mount(ts.URL + "/?timeout=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = fs.Stat(context.Background(), "/"); err == nil {
+		t.Fatal("Stat of hung upstream succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Stat took %v", d)
+	}
+}
@@ -0,0 +1,671 @@
+package davfs
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+var (
+	// ErrNotSupported is returned by the optional methods which the
+	// filesystem can't serve, e.g. Usage of old databases.
+	ErrNotSupported = errors.New("davfs: not supported")
+	// ErrQuotaExceeded is returned by writes over the quota.
+	ErrQuotaExceeded = errors.New("davfs: quota exceeded")
+)
+
+// Quota limits bytes and number of the entries under the directory. zero
+// means no limit.
+type Quota struct {
+	Bytes int64
+	Files int64
+}
+
+// Usager is implemented by the filesystems which maintain bytes and number
+// of the entries under directories, so that QuotaFS need not walk them.
+type Usager interface {
+	Usage(ctx context.Context, name string) (bytes int64, files int64, err error)
+}
+
+type usage struct {
+	bytes int64
+	files int64
+}
+
+// QuotaFS is the filesystem which enforces quotas of the directories of
+// other filesystem. usage is asked to the filesystem if it is a Usager,
+// otherwise it is counted by walking once and maintained in memory.
+//
+// Usagers may not count writes until the file is closed, so usage of the
+// quotas counting files open for writing is held in memory from the open
+// until the last of them is closed.
+//
+// entries in the trash and previous versions are not counted, so that
+// deleting entries frees quotas at once.
+type QuotaFS struct {
+	fs     webdav.FileSystem
+	quotas map[string]Quota
+	mu     sync.Mutex
+	usages map[string]*usage
+	pins   map[string]int
+}
+
+type quotaFile struct {
+	webdav.File
+	q      *QuotaFS
+	name   string
+	off    int64
+	size   int64
+	pinned []string
+	props  bool
+}
+
+type quotaPropsKey struct{}
+
+// WithQuotaProps returns the context which asks QuotaFS to report RFC 4331
+// properties of the directories opened with it. they are live properties,
+// which must be reported only to PROPFIND naming them, not to allprop.
+func WithQuotaProps(ctx context.Context) context.Context {
+	return context.WithValue(ctx, quotaPropsKey{}, true)
+}
+
+func NewQuotaFS(fs webdav.FileSystem, quotas map[string]Quota) (*QuotaFS, error) {
+	q := &QuotaFS{fs: fs, quotas: map[string]Quota{}, usages: map[string]*usage{}, pins: map[string]int{}}
+	for name, quota := range quotas {
+		name, err := cleanName(name)
+		if err != nil {
+			return nil, err
+		}
+		q.quotas[name] = quota
+	}
+	return q, nil
+}
+
+// roots returns the directories which have quotas counting the name,
+// nearest first.
+func (q *QuotaFS) roots(name string) []string {
+	if uncounted(name) {
+		return nil
+	}
+	return q.limits(path.Dir(name))
+}
+
+// uncounted reports whether the name is in the trash or previous versions.
+func uncounted(name string) bool {
+	return isTrash(name) || isVersions(name)
+}
+
+// stored returns the usage of the directory told by the Usager, except the
+// trash and previous versions.
+func (q *QuotaFS) stored(ctx context.Context, us Usager, name string) (usage, error) {
+	bytes, files, err := us.Usage(ctx, name)
+	if err != nil || name != "/" {
+		return usage{bytes, files}, err
+	}
+	u := usage{bytes, files}
+	for _, dir := range []string{trashDir, versionsDir} {
+		if _, err = q.fs.Stat(ctx, dir); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return u, err
+		}
+		if bytes, files, err = us.Usage(ctx, dir); err != nil {
+			return u, err
+		}
+		u.bytes -= bytes
+		u.files -= files + 1
+	}
+	return u, nil
+}
+
+// limits returns the directory and its ancestors which have quotas.
+func (q *QuotaFS) limits(name string) []string {
+	var roots []string
+	for dir := name; ; dir = path.Dir(dir) {
+		if _, ok := q.quotas[dir]; ok {
+			roots = append(roots, dir)
+		}
+		if dir == "/" {
+			return roots
+		}
+	}
+}
+
+func (q *QuotaFS) walk(ctx context.Context, name string) (usage, error) {
+	var u usage
+	f, err := q.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return u, err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return u, err
+	}
+	for _, fi := range children {
+		if uncounted(path.Join(name, fi.Name())) {
+			continue
+		}
+		u.files++
+		if !fi.IsDir() {
+			// sizes in listings may be the stored ones, e.g. of CompressFS.
+			if fi, err = q.fs.Stat(ctx, path.Join(name, fi.Name())); err != nil {
+				return u, err
+			}
+			u.bytes += fi.Size()
+			continue
+		}
+		cu, err := q.walk(ctx, path.Join(name, fi.Name()))
+		if err != nil {
+			return u, err
+		}
+		u.bytes += cu.bytes
+		u.files += cu.files
+	}
+	return u, nil
+}
+
+// usage returns the usage of the directory.
+func (q *QuotaFS) usage(ctx context.Context, name string) (usage, error) {
+	q.mu.Lock()
+	pu, ok := q.usages[name]
+	q.mu.Unlock()
+	if ok {
+		return *pu, nil
+	}
+	if us, ok := q.fs.(Usager); ok {
+		u, err := q.stored(ctx, us, name)
+		if err != ErrNotSupported {
+			return u, err
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if u, ok := q.usages[name]; ok {
+		return *u, nil
+	}
+	u, err := q.walk(ctx, name)
+	if err != nil {
+		return u, err
+	}
+	q.usages[name] = &u
+	return u, nil
+}
+
+// entryUsage returns the usage of the entry, including itself.
+func (q *QuotaFS) entryUsage(ctx context.Context, name string) (usage, error) {
+	fi, err := q.fs.Stat(ctx, name)
+	if err != nil {
+		return usage{}, err
+	}
+	if !fi.IsDir() {
+		return usage{fi.Size(), 1}, nil
+	}
+	u, err := q.usage(ctx, name)
+	u.files++
+	return u, err
+}
+
+// check returns ErrQuotaExceeded if adding bytes and files to the name
+// exceeds any quota, except the ones of the directories in skip.
+func (q *QuotaFS) check(ctx context.Context, name string, bytes, files int64, skip ...string) error {
+	for _, root := range q.roots(name) {
+		if hasName(skip, root) {
+			continue
+		}
+		quota := q.quotas[root]
+		u, err := q.usage(ctx, root)
+		if err != nil {
+			return err
+		}
+		if (quota.Bytes > 0 && bytes > 0 && u.bytes+bytes > quota.Bytes) ||
+			(quota.Files > 0 && files > 0 && u.files+files > quota.Files) {
+			return ErrQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// reserve adds bytes to the usages counted in memory if no quota is
+// exceeded. the usages are checked and added at once, so that concurrent
+// writes can't exceed quotas together.
+func (q *QuotaFS) reserve(ctx context.Context, name string, bytes int64) error {
+	if err := q.check(ctx, name, bytes, 0); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	roots := q.roots(name)
+	for _, root := range roots {
+		quota := q.quotas[root]
+		if u, ok := q.usages[root]; ok && quota.Bytes > 0 && u.bytes+bytes > quota.Bytes {
+			return ErrQuotaExceeded
+		}
+	}
+	for _, root := range roots {
+		if u, ok := q.usages[root]; ok {
+			u.bytes += bytes
+		}
+	}
+	return nil
+}
+
+// pin holds the usages of the quotas counting the name in memory, taken
+// from Usager before the file is opened for writing. it returns the roots
+// to be unpinned.
+func (q *QuotaFS) pin(ctx context.Context, name string) ([]string, error) {
+	us, ok := q.fs.(Usager)
+	if !ok {
+		return nil, nil
+	}
+	var pinned []string
+	for _, root := range q.roots(name) {
+		q.mu.Lock()
+		n := q.pins[root]
+		if n > 0 {
+			q.pins[root]++
+		}
+		q.mu.Unlock()
+		if n > 0 {
+			pinned = append(pinned, root)
+			continue
+		}
+
+		u, err := q.stored(ctx, us, root)
+		if err == ErrNotSupported {
+			// counted in memory anyway.
+			continue
+		}
+		if err != nil {
+			q.unpin(pinned)
+			return nil, err
+		}
+		q.mu.Lock()
+		if q.pins[root] == 0 {
+			q.usages[root] = &u
+		}
+		q.pins[root]++
+		q.mu.Unlock()
+		pinned = append(pinned, root)
+	}
+	return pinned, nil
+}
+
+// unpin drops the usages held by pin when no file counted by them is open,
+// so that Usager is asked again.
+func (q *QuotaFS) unpin(roots []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, root := range roots {
+		if q.pins[root]--; q.pins[root] <= 0 {
+			delete(q.pins, root)
+			delete(q.usages, root)
+		}
+	}
+}
+
+// add maintains the usages counted in memory.
+func (q *QuotaFS) add(name string, bytes, files int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, root := range q.roots(name) {
+		if u, ok := q.usages[root]; ok {
+			u.bytes += bytes
+			u.files += files
+		}
+	}
+}
+
+// counted reports whether the name is counted in memory.
+func (q *QuotaFS) counted(name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, root := range q.roots(name) {
+		if _, ok := q.usages[root]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Available returns bytes which can be written to the directory, or -1 if
+// no quota limits it.
+func (q *QuotaFS) Available(ctx context.Context, name string) (int64, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return 0, err
+	}
+	return q.available(ctx, name)
+}
+
+func (q *QuotaFS) available(ctx context.Context, name string) (int64, error) {
+	avail := int64(-1)
+	for _, root := range q.limits(name) {
+		quota := q.quotas[root]
+		if quota.Bytes == 0 {
+			continue
+		}
+		u, err := q.usage(ctx, root)
+		if err != nil {
+			return 0, err
+		}
+		n := quota.Bytes - u.bytes
+		if n < 0 {
+			n = 0
+		}
+		if avail < 0 || n < avail {
+			avail = n
+		}
+	}
+	return avail, nil
+}
+
+// Watch passes changes by others through, dropping the usages counted in
+// memory for them.
+func (q *QuotaFS) Watch(fn func(name string)) error {
+	w, ok := q.fs.(Watcher)
+	if !ok {
+		return nil
+	}
+	return w.Watch(func(name string) {
+		q.mu.Lock()
+		for _, root := range q.limits(path.Clean("/" + name)) {
+			// pinned usages hold writes which the filesystem hasn't seen.
+			if q.pins[root] == 0 {
+				delete(q.usages, root)
+			}
+		}
+		q.mu.Unlock()
+		fn(name)
+	})
+}
+
+func (q *QuotaFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if err = q.check(ctx, name, 0, 1); err != nil {
+		return err
+	}
+	if err = q.fs.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	q.add(name, 0, 1)
+	return nil
+}
+
+func (q *QuotaFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	fi, err := q.fs.Stat(ctx, name)
+	switch {
+	case err == nil:
+		size = fi.Size()
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		if err = q.check(ctx, name, 0, 1); err != nil {
+			return nil, err
+		}
+	}
+
+	var pinned []string
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+		if pinned, err = q.pin(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := q.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		q.unpin(pinned)
+		return nil, err
+	}
+	if fi == nil && flag&os.O_CREATE != 0 {
+		q.add(name, 0, 1)
+	}
+	if fi != nil && !fi.IsDir() && flag&os.O_TRUNC != 0 {
+		q.add(name, -size, 0)
+		size = 0
+	}
+	props, _ := ctx.Value(quotaPropsKey{}).(bool)
+	qf := &quotaFile{File: f, q: q, name: name, size: size, pinned: pinned, props: props}
+	if flag&os.O_APPEND != 0 {
+		qf.off = size
+	}
+	return qf, nil
+}
+
+func (q *QuotaFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if !q.counted(name) {
+		return q.fs.RemoveAll(ctx, name)
+	}
+	u, err := q.entryUsage(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err = q.fs.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	q.add(name, -u.bytes, -u.files)
+	return nil
+}
+
+func (q *QuotaFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	// quotas counting both names are not changed.
+	skip := q.roots(oldName)
+	var limited bool
+	for _, root := range q.roots(newName) {
+		limited = limited || !hasName(skip, root)
+	}
+	if !limited && !q.counted(oldName) && !q.counted(newName) {
+		return q.fs.Rename(ctx, oldName, newName)
+	}
+
+	u, err := q.entryUsage(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err = q.check(ctx, newName, u.bytes, u.files, skip...); err != nil {
+		return err
+	}
+	if err = q.fs.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	q.add(oldName, -u.bytes, -u.files)
+	q.add(newName, u.bytes, u.files)
+	return nil
+}
+
+func (q *QuotaFS) Copy(ctx context.Context, oldName, newName string) error {
+	c, ok := q.fs.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	if len(q.roots(newName)) == 0 && !q.counted(newName) {
+		return c.Copy(ctx, oldName, newName)
+	}
+
+	u, err := q.entryUsage(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if err = q.check(ctx, newName, u.bytes, u.files); err != nil {
+		return err
+	}
+	if err = c.Copy(ctx, oldName, newName); err != nil {
+		return err
+	}
+	q.add(newName, u.bytes, u.files)
+	return nil
+}
+
+func (q *QuotaFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return q.fs.Stat(ctx, name)
+}
+
+func (f *quotaFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	grow := f.off + int64(len(p)) - f.size
+	if grow > 0 {
+		if err := f.q.reserve(context.Background(), f.name, grow); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.File.Write(p)
+	f.off += int64(n)
+	if f.off > f.size {
+		f.size = f.off
+	}
+	if grow > 0 && n < len(p) {
+		// release the bytes which weren't written.
+		f.q.add(f.name, -min64(grow, int64(len(p)-n)), 0)
+	}
+	return n, err
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Close unpins the usages after the filesystem counts the writes.
+func (f *quotaFile) Close() error {
+	defer f.q.unpin(f.pinned)
+	return f.File.Close()
+}
+
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	off, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.off = off
+	}
+	return off, err
+}
+
+var (
+	quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// DeadProps adds RFC 4331 quota properties to the directories limited by
+// the quota of bytes, if they are opened with WithQuotaProps. webdav.Handler
+// reports only dead properties besides its own live ones.
+func (f *quotaFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	dp, err := deadProps(f.File)
+	if err != nil || !f.props {
+		return dp, err
+	}
+	props := map[xml.Name]webdav.Property{}
+	for name, p := range dp {
+		props[name] = p
+	}
+
+	fi, err := f.File.Stat()
+	if err != nil || !fi.IsDir() {
+		return props, err
+	}
+	ctx := context.Background()
+	avail, err := f.q.available(ctx, f.name)
+	if err != nil || avail < 0 {
+		return props, err
+	}
+	// used bytes are the ones counted against the nearest quota.
+	var used int64
+	for _, root := range f.q.limits(f.name) {
+		if f.q.quotas[root].Bytes == 0 {
+			continue
+		}
+		u, err := f.q.usage(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+		used = u.bytes
+		break
+	}
+	props[quotaAvailableBytes] = webdav.Property{
+		XMLName:  quotaAvailableBytes,
+		InnerXML: []byte(strconv.FormatInt(avail, 10)),
+	}
+	props[quotaUsedBytes] = webdav.Property{
+		XMLName:  quotaUsedBytes,
+		InnerXML: []byte(strconv.FormatInt(used, 10)),
+	}
+	return props, nil
+}
+
+// Patch refuses patches of the quota properties, which are protected, and
+// others with them.
+func (f *quotaFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	protected := webdav.Propstat{
+		Status:   http.StatusForbidden,
+		XMLError: `<D:cannot-modify-protected-property xmlns:D="DAV:"/>`,
+	}
+	failed := webdav.Propstat{Status: http.StatusFailedDependency}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if p.XMLName == quotaAvailableBytes || p.XMLName == quotaUsedBytes {
+				protected.Props = append(protected.Props, webdav.Property{XMLName: p.XMLName})
+			} else {
+				failed.Props = append(failed.Props, webdav.Property{XMLName: p.XMLName})
+			}
+		}
+	}
+	if len(protected.Props) == 0 {
+		return patchProps(f.File, patches)
+	}
+	if len(failed.Props) == 0 {
+		return []webdav.Propstat{protected}, nil
+	}
+	return []webdav.Propstat{protected, failed}, nil
+}
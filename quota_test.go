@@ -0,0 +1,183 @@
+package davfs
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// closeUsager is the filesystem in memory which counts bytes of the files
+// when they are closed, as the SQL filesystems do.
+type closeUsager struct {
+	webdav.FileSystem
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+type closeUsagerFile struct {
+	webdav.File
+	fs   *closeUsager
+	name string
+}
+
+func newCloseUsager() *closeUsager {
+	return &closeUsager{FileSystem: webdav.NewMemFS(), sizes: map[string]int64{}}
+}
+
+func (fs *closeUsager) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &closeUsagerFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *closeUsager) Usage(ctx context.Context, name string) (int64, int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var bytes, files int64
+	for n, size := range fs.sizes {
+		if name == "/" || strings.HasPrefix(n, name+"/") {
+			bytes += size
+			files++
+		}
+	}
+	return bytes, files, nil
+}
+
+func (f *closeUsagerFile) Close() error {
+	fi, err := f.File.Stat()
+	if err == nil && !fi.IsDir() {
+		f.fs.mu.Lock()
+		f.fs.sizes[f.name] = fi.Size()
+		f.fs.mu.Unlock()
+	}
+	return f.File.Close()
+}
+
+func TestQuotaOpenFiles(t *testing.T) {
+	ctx := context.Background()
+	fs := newCloseUsager()
+	if err := fs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	q, err := NewQuotaFS(fs, map[string]Quota{"/dir": {Bytes: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, q, "/dir/a.txt", "hello")
+
+	// writes of open files count before the filesystem sees them.
+	f, err := q.OpenFile(ctx, "/dir/b.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(f, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+	if avail, err := q.Available(ctx, "/dir"); err != nil || avail != 1 {
+		t.Fatalf("Available while open: %v, %v", avail, err)
+	}
+	if _, err = io.WriteString(f, "ef"); err != ErrQuotaExceeded {
+		t.Fatalf("Write over quota: %v", err)
+	}
+	g, err := q.OpenFile(ctx, "/dir/c.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(g, "xy"); err != ErrQuotaExceeded {
+		t.Fatalf("Write of other file over quota: %v", err)
+	}
+	g.Close()
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if avail, err := q.Available(ctx, "/dir"); err != nil || avail != 1 {
+		t.Fatalf("Available after close: %v, %v", avail, err)
+	}
+	putFile(t, q, "/dir/a.txt", "")
+	if avail, err := q.Available(ctx, "/dir"); err != nil || avail != 6 {
+		t.Fatalf("Available after truncation: %v, %v", avail, err)
+	}
+}
+
+func TestQuotaTrash(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewQuotaFS(webdav.NewMemFS(), map[string]Quota{"/": {Bytes: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfs := NewTrashFS(NewVersionFS(q, VersionOptions{MaxVersions: 2}), 0)
+
+	putFile(t, tfs, "/a.txt", "12345678")
+	putFile(t, tfs, "/a.txt", "87654321")
+	if err = tfs.RemoveAll(ctx, "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// trashed entries and versions don't hold the quota.
+	putFile(t, tfs, "/b.txt", "12345678")
+	if avail, err := q.Available(ctx, "/"); err != nil || avail != 2 {
+		t.Fatalf("Available after delete: %v, %v", avail, err)
+	}
+}
+
+func TestQuotaUsagerTrash(t *testing.T) {
+	ctx := context.Background()
+	fs := newCloseUsager()
+	if err := fs.Mkdir(ctx, trashDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, fs, trashDir+"/a.txt", "12345678")
+	putFile(t, fs, "/b.txt", "12")
+	q, err := NewQuotaFS(fs, map[string]Quota{"/": {Bytes: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avail, err := q.Available(ctx, "/"); err != nil || avail != 8 {
+		t.Fatalf("Available with trash: %v, %v", avail, err)
+	}
+}
+
+func TestQuotaProps(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewQuotaFS(webdav.NewMemFS(), map[string]Quota{"/": {Bytes: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ctx  context.Context
+		want int
+	}{{ctx, 0}, {WithQuotaProps(ctx), 2}} {
+		f, err := q.OpenFile(c.ctx, "/", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		props, err := f.(webdav.DeadPropsHolder).DeadProps()
+		f.Close()
+		if err != nil || len(props) != c.want {
+			t.Fatalf("DeadProps: %v %v", props, err)
+		}
+	}
+
+	f, err := q.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pstats, err := f.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{Props: []webdav.Property{
+		{XMLName: quotaUsedBytes, InnerXML: []byte("0")},
+		{XMLName: xml.Name{Space: "urn:x", Local: "color"}, InnerXML: []byte("red")},
+	}}})
+	if err != nil || len(pstats) != 2 || pstats[0].Status != http.StatusForbidden || pstats[1].Status != http.StatusFailedDependency {
+		t.Fatalf("Patch of quota property: %v %v", pstats, err)
+	}
+}
@@ -0,0 +1,68 @@
+package davfs
+
+import (
+	"encoding/xml"
+	"os"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// ReadOnlyFS is the filesystem which rejects all writes to other
+// filesystem with os.ErrPermission.
+type ReadOnlyFS struct {
+	fs webdav.FileSystem
+}
+
+type readOnlyFile struct {
+	webdav.File
+}
+
+func NewReadOnlyFS(fs webdav.FileSystem) *ReadOnlyFS {
+	return &ReadOnlyFS{fs: fs}
+}
+
+func (r *ReadOnlyFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (r *ReadOnlyFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	f, err := r.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{f}, nil
+}
+
+func (r *ReadOnlyFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (r *ReadOnlyFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (r *ReadOnlyFS) Copy(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (r *ReadOnlyFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return r.fs.Stat(ctx, name)
+}
+
+func (f *readOnlyFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// DeadProps returns dead properties of the file if it has, so that
+// PROPFIND works as before.
+func (f *readOnlyFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *readOnlyFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return nil, os.ErrPermission
+}
@@ -0,0 +1,49 @@
+package davfs
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	putFile(t, fs, "/a.txt", "a")
+	ro := NewReadOnlyFS(fs)
+
+	if err := ro.Mkdir(ctx, "/dir", 0755); err != os.ErrPermission {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_RDONLY | os.O_CREATE, os.O_RDONLY | os.O_TRUNC, os.O_RDONLY | os.O_APPEND} {
+		if _, err := ro.OpenFile(ctx, "/a.txt", flag, 0644); err != os.ErrPermission {
+			t.Fatalf("OpenFile with %x: %v", flag, err)
+		}
+	}
+	if err := ro.RemoveAll(ctx, "/a.txt"); err != os.ErrPermission {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if err := ro.Rename(ctx, "/a.txt", "/b.txt"); err != os.ErrPermission {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := ro.Copy(ctx, "/a.txt", "/b.txt"); err != os.ErrPermission {
+		t.Fatalf("Copy: %v", err)
+	}
+
+	f, err := ro.OpenFile(ctx, "/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write([]byte("b")); err != os.ErrPermission {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err = f.(webdav.DeadPropsHolder).Patch(nil); err != os.ErrPermission {
+		t.Fatalf("Patch: %v", err)
+	}
+	if s := getFile(t, ro, "/a.txt"); s != "a" {
+		t.Fatalf("content: %q", s)
+	}
+}
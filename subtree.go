@@ -0,0 +1,143 @@
+package davfs
+
+import (
+	"encoding/xml"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// SubtreeFS is the filesystem which exposes the directory of other
+// filesystem as its root. names are cleaned before they are joined, so ..
+// can't escape from the directory.
+type SubtreeFS struct {
+	fs   webdav.FileSystem
+	root string
+}
+
+type subtreeFile struct {
+	webdav.File
+}
+
+func NewSubtreeFS(fs webdav.FileSystem, root string) (*SubtreeFS, error) {
+	root, err := cleanName(root)
+	if err != nil {
+		return nil, err
+	}
+	return &SubtreeFS{fs: fs, root: root}, nil
+}
+
+// resolve returns the name in the underlying filesystem.
+func (s *SubtreeFS) resolve(name string) string {
+	slashed := strings.HasSuffix(name, "/")
+	name = path.Join(s.root, path.Clean("/"+name))
+	if slashed && !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return name
+}
+
+func (s *SubtreeFS) isRoot(name string) bool {
+	return path.Clean("/"+name) == "/"
+}
+
+func (s *SubtreeFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if s.isRoot(name) {
+		return os.ErrExist
+	}
+	return s.fs.Mkdir(ctx, s.resolve(name), perm)
+}
+
+func (s *SubtreeFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := s.fs.OpenFile(ctx, s.resolve(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if s.isRoot(name) {
+		return &subtreeFile{f}, nil
+	}
+	return f, nil
+}
+
+func (s *SubtreeFS) RemoveAll(ctx context.Context, name string) error {
+	if s.isRoot(name) {
+		return os.ErrPermission
+	}
+	return s.fs.RemoveAll(ctx, s.resolve(name))
+}
+
+func (s *SubtreeFS) Rename(ctx context.Context, oldName, newName string) error {
+	if s.isRoot(oldName) || s.isRoot(newName) {
+		return os.ErrPermission
+	}
+	return s.fs.Rename(ctx, s.resolve(oldName), s.resolve(newName))
+}
+
+func (s *SubtreeFS) Copy(ctx context.Context, oldName, newName string) error {
+	c, ok := s.fs.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	if s.isRoot(newName) {
+		return os.ErrPermission
+	}
+	return c.Copy(ctx, s.resolve(oldName), s.resolve(newName))
+}
+
+func (s *SubtreeFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := s.fs.Stat(ctx, s.resolve(name))
+	if err != nil {
+		return nil, err
+	}
+	if s.isRoot(name) {
+		return &namedInfo{fi, "/"}, nil
+	}
+	return fi, nil
+}
+
+// Watch calls fn with the names in the subtree when the underlying
+// filesystem is a Watcher. changes of the ancestors are told as /.
+func (s *SubtreeFS) Watch(fn func(name string)) error {
+	w, ok := s.fs.(Watcher)
+	if !ok {
+		return nil
+	}
+	return w.Watch(func(name string) {
+		name = path.Clean("/" + name)
+		switch {
+		case s.root == "/":
+			fn(name)
+		case name == s.root || strings.HasPrefix(s.root, strings.TrimSuffix(name, "/")+"/"):
+			fn("/")
+		case strings.HasPrefix(name, s.root+"/"):
+			fn(name[len(s.root):])
+		}
+	})
+}
+
+func (s *SubtreeFS) Usage(ctx context.Context, name string) (int64, int64, error) {
+	us, ok := s.fs.(Usager)
+	if !ok {
+		return 0, 0, ErrNotSupported
+	}
+	return us.Usage(ctx, s.resolve(name))
+}
+
+func (f *subtreeFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &namedInfo{fi, "/"}, nil
+}
+
+func (f *subtreeFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *subtreeFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
@@ -0,0 +1,57 @@
+package davfs
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestSubtreeEscape(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	for _, dir := range []string{"/a", "/a/sub", "/b"} {
+		if err := fs.Mkdir(ctx, dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putFile(t, fs, "/b/secret.txt", "secret")
+	putFile(t, fs, "/a/sub/x.txt", "x")
+	sub, err := NewSubtreeFS(fs, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/../b/secret.txt", "../b/secret.txt", "/sub/../../b/secret.txt", "/b/secret.txt"} {
+		if _, err := sub.Stat(ctx, name); !os.IsNotExist(err) {
+			t.Fatalf("Stat of %s: %v", name, err)
+		}
+		if _, err := sub.OpenFile(ctx, name, os.O_RDONLY, 0); !os.IsNotExist(err) {
+			t.Fatalf("OpenFile of %s: %v", name, err)
+		}
+	}
+	if err := sub.Mkdir(ctx, "/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Rename(ctx, "/sub/x.txt", "/../b/x.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s := getFile(t, fs, "/a/b/x.txt"); s != "x" {
+		t.Fatalf("content of renamed file: %q", s)
+	}
+	if _, err := fs.Stat(ctx, "/b/x.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of escaped destination: %v", err)
+	}
+	if err := sub.RemoveAll(ctx, "/.."); err != os.ErrPermission {
+		t.Fatalf("RemoveAll of parent: %v", err)
+	}
+	if s := getFile(t, fs, "/b/secret.txt"); s != "secret" {
+		t.Fatalf("content outside the subtree: %q", s)
+	}
+
+	fi, err := sub.Stat(ctx, "/")
+	if err != nil || fi.Name() != "/" {
+		t.Fatalf("Stat of root: %v %v", fi, err)
+	}
+}
@@ -0,0 +1,355 @@
+package davfs
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// trashDir is the hidden directory which holds deleted entries. each entry
+// is the directory named by its ID, which has the info file of original
+// path and deletion time, and the data entry moved from there.
+const trashDir = "/.trash"
+
+// TrashEntry is the deleted entry in the trash.
+type TrashEntry struct {
+	ID      string
+	Path    string
+	Deleted time.Time
+	IsDir   bool
+	Size    int64
+}
+
+// TrashFS is the filesystem which moves deleted entries into the trash of
+// other filesystem instead of removing them. the trash is hidden from
+// clients, and entries older than the retention are removed by Purge.
+type TrashFS struct {
+	fs        webdav.FileSystem
+	retention time.Duration
+	mu        sync.Mutex
+	last      int64
+}
+
+// hiddenFile hides the entry from the listing of the directory.
+type hiddenFile struct {
+	webdav.File
+	hidden string
+}
+
+// NewTrashFS returns TrashFS which keeps deleted entries for retention.
+// zero retention keeps them until restored.
+func NewTrashFS(fs webdav.FileSystem, retention time.Duration) *TrashFS {
+	return &TrashFS{fs: fs, retention: retention}
+}
+
+func isTrash(name string) bool {
+	return name == trashDir || strings.HasPrefix(name, trashDir+"/")
+}
+
+// newID returns the unique ID ordered by deletion time.
+func (t *TrashFS) newID(now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := now.UnixNano()
+	if id <= t.last {
+		id = t.last + 1
+	}
+	t.last = id
+	return strconv.FormatInt(id, 36)
+}
+
+func (t *TrashFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if isTrash(name) {
+		return os.ErrPermission
+	}
+	return t.fs.Mkdir(ctx, name, perm)
+}
+
+func (t *TrashFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	if isTrash(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := t.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if name == "/" {
+		return &hiddenFile{f, path.Base(trashDir)}, nil
+	}
+	return f, nil
+}
+
+// RemoveAll moves the entry into the trash.
+func (t *TrashFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if name == "/" {
+		return os.ErrPermission
+	}
+	if isTrash(name) {
+		return os.ErrNotExist
+	}
+	if _, err = t.fs.Stat(ctx, name); err != nil {
+		return err
+	}
+
+	if _, err = t.fs.Stat(ctx, trashDir); os.IsNotExist(err) {
+		err = t.fs.Mkdir(ctx, trashDir, 0700)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	dir := path.Join(trashDir, t.newID(now))
+	if err = t.fs.Mkdir(ctx, dir, 0700); err != nil {
+		return err
+	}
+	if err = t.writeInfo(ctx, dir, name, now); err == nil {
+		err = t.fs.Rename(ctx, name, path.Join(dir, "data"))
+	}
+	if err != nil {
+		t.fs.RemoveAll(ctx, dir)
+		return err
+	}
+	return nil
+}
+
+// writeInfo writes the info file in the format of freedesktop.org trash.
+func (t *TrashFS) writeInfo(ctx context.Context, dir, name string, now time.Time) error {
+	f, err := t.fs.OpenFile(ctx, path.Join(dir, "info"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	u := &url.URL{Path: name}
+	_, err = fmt.Fprintf(f, "[Trash Info]\nPath=%s\nDeletionDate=%s\n", u.EscapedPath(), now.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (t *TrashFS) readInfo(ctx context.Context, id string) (*TrashEntry, error) {
+	dir := path.Join(trashDir, id)
+	f, err := t.fs.OpenFile(ctx, path.Join(dir, "info"), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	e := &TrashEntry{ID: id}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		token := strings.SplitN(scanner.Text(), "=", 2)
+		if len(token) != 2 {
+			continue
+		}
+		switch token[0] {
+		case "Path":
+			if e.Path, err = url.PathUnescape(token[1]); err != nil {
+				return nil, err
+			}
+		case "DeletionDate":
+			if e.Deleted, err = time.Parse(time.RFC3339Nano, token[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if e.Path == "" {
+		return nil, os.ErrInvalid
+	}
+
+	fi, err := t.fs.Stat(ctx, path.Join(dir, "data"))
+	if err != nil {
+		return nil, err
+	}
+	e.IsDir = fi.IsDir()
+	if !e.IsDir {
+		e.Size = fi.Size()
+	}
+	return e, nil
+}
+
+// List returns the entries in the trash, older first. broken entries, e.g.
+// left by crashes while deleting, are skipped.
+func (t *TrashFS) List(ctx context.Context) ([]*TrashEntry, error) {
+	f, err := t.fs.OpenFile(ctx, trashDir, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*TrashEntry
+	for _, fi := range children {
+		e, err := t.readInfo(ctx, fi.Name())
+		if err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+	return entries, nil
+}
+
+// Restore moves the entry back to its original path, or to the name if
+// it is not empty. missing parent directories are created.
+func (t *TrashFS) Restore(ctx context.Context, id, name string) error {
+	if strings.Contains(id, "/") {
+		return os.ErrInvalid
+	}
+	e, err := t.readInfo(ctx, id)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = e.Path
+	}
+	if name, err = cleanName(name); err != nil {
+		return err
+	}
+	if name == "/" || isTrash(name) {
+		return os.ErrInvalid
+	}
+	if _, err = t.fs.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+
+	if err = mkdirAll(ctx, t.fs, path.Dir(name)); err != nil {
+		return err
+	}
+
+	dir := path.Join(trashDir, id)
+	if err = t.fs.Rename(ctx, path.Join(dir, "data"), name); err != nil {
+		return err
+	}
+	return t.fs.RemoveAll(ctx, dir)
+}
+
+// Purge removes the entries older than the retention permanently.
+func (t *TrashFS) Purge(ctx context.Context) error {
+	if t.retention <= 0 {
+		return nil
+	}
+	entries, err := t.List(ctx)
+	if err != nil {
+		return err
+	}
+	expired := time.Now().Add(-t.retention)
+	for _, e := range entries {
+		if e.Deleted.After(expired) {
+			break
+		}
+		if err = t.fs.RemoveAll(ctx, path.Join(trashDir, e.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TrashFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	if isTrash(oldName) || isTrash(newName) {
+		return os.ErrPermission
+	}
+	return t.fs.Rename(ctx, oldName, newName)
+}
+
+func (t *TrashFS) Copy(ctx context.Context, oldName, newName string) error {
+	c, ok := t.fs.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	if isTrash(oldName) || isTrash(newName) {
+		return os.ErrPermission
+	}
+	return c.Copy(ctx, oldName, newName)
+}
+
+func (t *TrashFS) Watch(fn func(name string)) error {
+	if w, ok := t.fs.(Watcher); ok {
+		return w.Watch(fn)
+	}
+	return nil
+}
+
+func (t *TrashFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	if isTrash(name) {
+		return nil, os.ErrNotExist
+	}
+	return t.fs.Stat(ctx, name)
+}
+
+func (f *hiddenFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *hiddenFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
+
+func (f *hiddenFile) Readdir(count int) ([]os.FileInfo, error) {
+	children, err := f.File.Readdir(count)
+	fis := make([]os.FileInfo, 0, len(children))
+	for _, fi := range children {
+		if fi.Name() != f.hidden {
+			fis = append(fis, fi)
+		}
+	}
+	if err == nil && count > 0 && len(children) > 0 && len(fis) == 0 {
+		// the hidden entry was the only entry of this page.
+		return f.Readdir(count)
+	}
+	return fis, err
+}
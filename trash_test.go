@@ -0,0 +1,146 @@
+package davfs
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	tfs := NewTrashFS(fs, time.Hour)
+
+	if err := tfs.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, tfs, "/dir/a.txt", "a")
+	putFile(t, tfs, "/b.txt", "bb")
+	if err := tfs.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tfs.RemoveAll(ctx, "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfs.Stat(ctx, "/dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of removed file: %v", err)
+	}
+	if names := strings.Join(readNames(t, tfs, "/"), ","); names != "" {
+		t.Fatalf("Readdir of root: %v", names)
+	}
+	for _, name := range []string{trashDir, trashDir + "/x"} {
+		if _, err := tfs.Stat(ctx, name); !os.IsNotExist(err) {
+			t.Fatalf("Stat of %s: %v", name, err)
+		}
+		if err := tfs.RemoveAll(ctx, name); !os.IsNotExist(err) {
+			t.Fatalf("RemoveAll of %s: %v", name, err)
+		}
+	}
+
+	entries, err := tfs.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Path != "/dir" || !entries[0].IsDir || entries[1].Path != "/b.txt" || entries[1].Size != 2 {
+		t.Fatalf("List: %+v", entries)
+	}
+
+	if err = tfs.Restore(ctx, entries[0].ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if s := getFile(t, tfs, "/dir/a.txt"); s != "a" {
+		t.Fatalf("content of restored file: %q", s)
+	}
+	putFile(t, tfs, "/b.txt", "new")
+	if err = tfs.Restore(ctx, entries[1].ID, ""); err != os.ErrExist {
+		t.Fatalf("Restore over existing file: %v", err)
+	}
+	if err = tfs.Restore(ctx, entries[1].ID, "/old/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if s := getFile(t, tfs, "/old/b.txt"); s != "bb" {
+		t.Fatalf("content of file restored to other name: %q", s)
+	}
+	if entries, err = tfs.List(ctx); err != nil || len(entries) != 0 {
+		t.Fatalf("List after Restore: %v %v", entries, err)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	tfs := NewTrashFS(fs, time.Hour)
+	putFile(t, tfs, "/a.txt", "a")
+	putFile(t, tfs, "/b.txt", "b")
+	if err := tfs.RemoveAll(ctx, "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tfs.RemoveAll(ctx, "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := tfs.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// age the first entry beyond the retention.
+	old := time.Now().Add(-2 * time.Hour)
+	if err = tfs.writeInfo(ctx, trashDir+"/"+entries[0].ID, entries[0].Path, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tfs.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = tfs.List(ctx); err != nil || len(entries) != 1 || entries[0].Path != "/b.txt" {
+		t.Fatalf("List after Purge: %+v %v", entries, err)
+	}
+	if err = NewTrashFS(fs, 0).Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = tfs.List(ctx); err != nil || len(entries) != 1 {
+		t.Fatalf("List after Purge without retention: %+v %v", entries, err)
+	}
+}
+
+func TestTrashReaddirPaged(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	tfs := NewTrashFS(fs, 0)
+	// .trash is sorted first by MemFS, so the first page has only it.
+	putFile(t, tfs, "/a.txt", "a")
+	putFile(t, tfs, "/x.txt", "x")
+	if err := tfs.RemoveAll(ctx, "/x.txt"); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, tfs, "/b.txt", "b")
+
+	f, err := tfs.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	for {
+		children, err := f.Readdir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(children) == 0 {
+			t.Fatal("empty page before EOF")
+		}
+		for _, fi := range children {
+			names = append(names, fi.Name())
+		}
+	}
+	if strings.Join(names, ",") != "a.txt,b.txt" {
+		t.Fatalf("Readdir: %v", names)
+	}
+}
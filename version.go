@@ -0,0 +1,383 @@
+package davfs
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// versionsDir is the read-only directory which holds previous versions of
+// files. versions of /path/to/file are /.versions/path/to/file/<ID>, where
+// ID is the time when the version was replaced.
+const versionsDir = "/.versions"
+
+// versionIDFormat sorts IDs by the time.
+const versionIDFormat = "20060102T150405.000000000Z"
+
+type VersionOptions struct {
+	// MaxVersions limits the number of versions of each file. zero means
+	// no limit.
+	MaxVersions int
+	// MaxAge limits the age of versions. zero means no limit.
+	MaxAge time.Duration
+}
+
+// VersionFS is the filesystem which keeps previous versions of files of
+// other filesystem on each overwrite. versions can be read, or copied back
+// to restore, under /.versions.
+type VersionFS struct {
+	fs   webdav.FileSystem
+	opts VersionOptions
+}
+
+// versionFile saves the version before the first Write.
+type versionFile struct {
+	webdav.File
+	v     *VersionFS
+	name  string
+	saved bool
+}
+
+// Version is the previous version of the file.
+type Version struct {
+	ID       string
+	Replaced time.Time
+	Size     int64
+}
+
+func NewVersionFS(fs webdav.FileSystem, opts VersionOptions) *VersionFS {
+	return &VersionFS{fs: fs, opts: opts}
+}
+
+func isVersions(name string) bool {
+	return name == versionsDir || strings.HasPrefix(name, versionsDir+"/")
+}
+
+func versionsOf(name string) string {
+	return path.Join(versionsDir, name)
+}
+
+// save copies the current content of the file as a new version. the
+// versions in keep are not pruned.
+func (v *VersionFS) save(ctx context.Context, name string, keep ...string) error {
+	fi, err := v.fs.Stat(ctx, name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Size() == 0 {
+		return nil
+	}
+
+	dir := versionsOf(name)
+	if err = mkdirAll(ctx, v.fs, dir); err != nil {
+		return err
+	}
+	id := path.Join(dir, time.Now().UTC().Format(versionIDFormat))
+	err = ErrNotSupported
+	if c, ok := v.fs.(Copier); ok {
+		err = c.Copy(ctx, name, id)
+	}
+	if err == ErrNotSupported {
+		err = copyAll(ctx, v.fs, name, v.fs, id)
+	}
+	if err != nil {
+		return err
+	}
+	return v.prune(ctx, name, keep...)
+}
+
+// prune removes the versions over the limits, except the ones in keep.
+func (v *VersionFS) prune(ctx context.Context, name string, keep ...string) error {
+	versions, err := v.Versions(ctx, name)
+	if err != nil {
+		return err
+	}
+	expired := time.Now().Add(-v.opts.MaxAge)
+	for i, ver := range versions {
+		over := v.opts.MaxVersions > 0 && i < len(versions)-v.opts.MaxVersions
+		old := v.opts.MaxAge > 0 && ver.Replaced.Before(expired)
+		if !over && !old {
+			break
+		}
+		if hasName(keep, ver.ID) {
+			continue
+		}
+		if err = v.fs.RemoveAll(ctx, path.Join(versionsOf(name), ver.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Versions returns the versions of the file, older first.
+func (v *VersionFS) Versions(ctx context.Context, name string) ([]*Version, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := v.fs.OpenFile(ctx, versionsOf(name), os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*Version
+	for _, fi := range children {
+		if fi.IsDir() {
+			continue
+		}
+		replaced, err := time.Parse(versionIDFormat, fi.Name())
+		if err != nil {
+			continue
+		}
+		versions = append(versions, &Version{ID: fi.Name(), Replaced: replaced, Size: fi.Size()})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID < versions[j].ID
+	})
+	return versions, nil
+}
+
+// Purge removes the versions older than MaxAge, including the ones of
+// removed files, which are not pruned by writes.
+func (v *VersionFS) Purge(ctx context.Context) error {
+	if v.opts.MaxAge <= 0 {
+		return nil
+	}
+	_, err := v.purge(ctx, versionsDir, time.Now().Add(-v.opts.MaxAge))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// purge removes the expired versions under the directory, and directories
+// left empty. it reports whether the directory became empty.
+func (v *VersionFS) purge(ctx context.Context, dir string, expired time.Time) (bool, error) {
+	f, err := v.fs.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	left := len(children)
+	for _, fi := range children {
+		name := path.Join(dir, fi.Name())
+		if fi.IsDir() {
+			empty, err := v.purge(ctx, name, expired)
+			if err != nil {
+				return false, err
+			}
+			if !empty {
+				continue
+			}
+		} else if replaced, err := time.Parse(versionIDFormat, fi.Name()); err != nil || !replaced.Before(expired) {
+			continue
+		}
+		if err = v.fs.RemoveAll(ctx, name); err != nil {
+			return false, err
+		}
+		left--
+	}
+	return left == 0, nil
+}
+
+// Restore replaces the content of the file with the version. the current
+// content is kept as a new version.
+func (v *VersionFS) Restore(ctx context.Context, name, id string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if isVersions(name) || strings.Contains(id, "/") {
+		return os.ErrInvalid
+	}
+	r, err := v.fs.OpenFile(ctx, path.Join(versionsOf(name), id), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// the version being read is kept until it is copied.
+	if err = v.save(ctx, name, id); err != nil {
+		return err
+	}
+	w, err := v.fs.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return v.prune(ctx, name)
+}
+
+func (v *VersionFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if isVersions(name) {
+		return os.ErrPermission
+	}
+	return v.fs.Mkdir(ctx, name, perm)
+}
+
+func (v *VersionFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	if isVersions(name) {
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+			return nil, os.ErrPermission
+		}
+		f, err := v.fs.OpenFile(ctx, name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &readOnlyFile{f}, nil
+	}
+
+	// files opened for writing without truncation, e.g. by PROPPATCH, are
+	// saved on the first Write.
+	if flag&os.O_TRUNC != 0 {
+		if err = v.save(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := v.fs.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if name == "/" {
+		return &hiddenFile{f, path.Base(versionsDir)}, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) != 0 && flag&os.O_TRUNC == 0 {
+		return &versionFile{File: f, v: v, name: name}, nil
+	}
+	return f, nil
+}
+
+// RemoveAll removes the entry, keeping its versions to be restored. entries
+// purged from the trash take their versions with them.
+func (v *VersionFS) RemoveAll(ctx context.Context, name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if name == "/" || isVersions(name) {
+		return os.ErrPermission
+	}
+	if err = v.fs.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	if !isTrash(name) {
+		return nil
+	}
+	if err = v.fs.RemoveAll(ctx, versionsOf(name)); os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Rename moves the entry and its versions.
+func (v *VersionFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	if isVersions(oldName) || isVersions(newName) {
+		return os.ErrPermission
+	}
+	if err = v.fs.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+
+	if _, err = v.fs.Stat(ctx, versionsOf(oldName)); err != nil {
+		return nil
+	}
+	if _, err = v.fs.Stat(ctx, versionsOf(newName)); err == nil {
+		// versions of the replaced entry are left as they are.
+		return nil
+	}
+	if err = mkdirAll(ctx, v.fs, path.Dir(versionsOf(newName))); err != nil {
+		return err
+	}
+	return v.fs.Rename(ctx, versionsOf(oldName), versionsOf(newName))
+}
+
+// Copy copies the entry without its versions.
+func (v *VersionFS) Copy(ctx context.Context, oldName, newName string) error {
+	c, ok := v.fs.(Copier)
+	if !ok {
+		return ErrNotSupported
+	}
+	oldName, err := cleanName(oldName)
+	if err != nil {
+		return err
+	}
+	if newName, err = cleanName(newName); err != nil {
+		return err
+	}
+	if isVersions(newName) {
+		return os.ErrPermission
+	}
+	return c.Copy(ctx, oldName, newName)
+}
+
+func (v *VersionFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return v.fs.Stat(ctx, name)
+}
+
+func (v *VersionFS) Watch(fn func(name string)) error {
+	if w, ok := v.fs.(Watcher); ok {
+		return w.Watch(fn)
+	}
+	return nil
+}
+
+func (f *versionFile) Write(p []byte) (int, error) {
+	if !f.saved {
+		if err := f.v.save(context.Background(), f.name); err != nil {
+			return 0, err
+		}
+		f.saved = true
+	}
+	return f.File.Write(p)
+}
+
+func (f *versionFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return deadProps(f.File)
+}
+
+func (f *versionFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return patchProps(f.File, patches)
+}
@@ -0,0 +1,167 @@
+package davfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+func TestVersionSave(t *testing.T) {
+	ctx := context.Background()
+	v := NewVersionFS(webdav.NewMemFS(), VersionOptions{})
+	putFile(t, v, "/a.txt", "one")
+	putFile(t, v, "/a.txt", "two")
+	if vers, err := v.Versions(ctx, "/a.txt"); err != nil || len(vers) != 1 {
+		t.Fatalf("Versions after overwrite: %v, %v", vers, err)
+	}
+
+	// e.g. PROPPATCH opens the file for writing without writes.
+	f, err := v.OpenFile(ctx, "/a.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if vers, err := v.Versions(ctx, "/a.txt"); err != nil || len(vers) != 1 {
+		t.Fatalf("Versions after open without writes: %v, %v", vers, err)
+	}
+
+	if f, err = v.OpenFile(ctx, "/a.txt", os.O_RDWR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(f, "T"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(f, "W"); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	vers, err := v.Versions(ctx, "/a.txt")
+	if err != nil || len(vers) != 2 {
+		t.Fatalf("Versions after writes: %v, %v", vers, err)
+	}
+	if err = v.Restore(ctx, "/a.txt", vers[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if s := getFile(t, v, "/a.txt"); s != "two" {
+		t.Fatalf("got %q", s)
+	}
+}
+
+func TestVersionTrashPurge(t *testing.T) {
+	ctx := context.Background()
+	v := NewVersionFS(webdav.NewMemFS(), VersionOptions{})
+	tr := NewTrashFS(v, time.Nanosecond)
+	putFile(t, tr, "/a.txt", "one")
+	putFile(t, tr, "/a.txt", "two")
+	if err := tr.RemoveAll(ctx, "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := tr.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Stat(ctx, versionsOf(trashDir)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := v.OpenFile(ctx, versionsOf(trashDir), os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if children, err := f.Readdir(-1); err != nil || len(children) != 0 {
+		t.Fatalf("versions of purged entries: %v, %v", children, err)
+	}
+}
+
+// strictFS fails reads of removed files, as the SQL filesystems do.
+type strictFS struct {
+	webdav.FileSystem
+}
+
+type strictFile struct {
+	webdav.File
+	fs   *strictFS
+	name string
+}
+
+func (fs *strictFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &strictFile{File: f, fs: fs, name: name}, nil
+}
+
+func (f *strictFile) Read(p []byte) (int, error) {
+	if _, err := f.fs.Stat(context.Background(), f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func TestVersionRestoreLimit(t *testing.T) {
+	ctx := context.Background()
+	v := NewVersionFS(&strictFS{webdav.NewMemFS()}, VersionOptions{MaxVersions: 1})
+	putFile(t, v, "/a.txt", "one")
+	putFile(t, v, "/a.txt", "two")
+	vers, err := v.Versions(ctx, "/a.txt")
+	if err != nil || len(vers) != 1 {
+		t.Fatalf("Versions: %v, %v", vers, err)
+	}
+	if err = v.Restore(ctx, "/a.txt", vers[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if s := getFile(t, v, "/a.txt"); s != "one" {
+		t.Fatalf("content of restored file: %q", s)
+	}
+	if vers, err = v.Versions(ctx, "/a.txt"); err != nil || len(vers) != 1 {
+		t.Fatalf("Versions after Restore: %v, %v", vers, err)
+	}
+	if s := getFile(t, v, path.Join(versionsOf("/a.txt"), vers[0].ID)); s != "two" {
+		t.Fatalf("content of replaced version: %q", s)
+	}
+}
+
+func TestVersionPurgeAge(t *testing.T) {
+	ctx := context.Background()
+	fs := webdav.NewMemFS()
+	v := NewVersionFS(fs, VersionOptions{MaxAge: time.Hour})
+	if err := v.Mkdir(ctx, "/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, v, "/dir/a.txt", "one")
+	putFile(t, v, "/dir/a.txt", "two")
+	putFile(t, v, "/b.txt", "one")
+	putFile(t, v, "/b.txt", "two")
+	if err := v.RemoveAll(ctx, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	// age the version of the removed file beyond MaxAge.
+	vers, err := v.Versions(ctx, "/dir/a.txt")
+	if err != nil || len(vers) != 1 {
+		t.Fatalf("Versions of removed file: %v, %v", vers, err)
+	}
+	old := path.Join(versionsOf("/dir/a.txt"), time.Now().Add(-2*time.Hour).UTC().Format(versionIDFormat))
+	if err = fs.Rename(ctx, path.Join(versionsOf("/dir/a.txt"), vers[0].ID), old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = v.Purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Stat(ctx, versionsOf("/dir")); !os.IsNotExist(err) {
+		t.Fatalf("Stat of expired versions: %v", err)
+	}
+	if vers, err = v.Versions(ctx, "/b.txt"); err != nil || len(vers) != 1 {
+		t.Fatalf("Versions of kept file: %v, %v", vers, err)
+	}
+}